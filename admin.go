@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+// adminAuthMiddleware は管理者用APIへのアクセスをトークンで制限する
+// adminTokenが設定されていない場合は管理者用APIを一切受け付けない
+func adminAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if adminToken == "" {
+			return newAPIError(http.StatusForbidden, "ADMIN_DISABLED", "admin api is disabled")
+		}
+		token := c.Request().Header.Get(adminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			return newAPIError(http.StatusForbidden, "INVALID_ADMIN_TOKEN", "invalid admin token")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// アイコン画像はJSONにbase64で埋め込まれて送られてくるので、他のAPIより大きめに許容する
+const maxIconRequestBodyBytes = 10 << 20
+
+// limitedBody はhttp.MaxBytesReaderで上限を超えたかを記録する
+// ハンドラはデコードエラーを400に変換してしまうので、超過したかどうかを後から判定するために使う
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// bodyLimitMiddleware はPOST/PUT/PATCHのリクエストボディの大きさを制限する
+// 上限を超えたリクエストには413を返す
+func bodyLimitMiddleware(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			switch req.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+			default:
+				return next(c)
+			}
+
+			routeLimit := limit
+			if c.Path() == "/api/icon" {
+				routeLimit = maxIconRequestBodyBytes
+			}
+
+			if req.ContentLength > routeLimit {
+				return newAPIError(http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", fmt.Sprintf("request body must be at most %d bytes", routeLimit))
+			}
+
+			body := &limitedBody{ReadCloser: http.MaxBytesReader(c.Response(), req.Body, routeLimit)}
+			req.Body = body
+
+			err := next(c)
+			if err != nil && body.exceeded {
+				return newAPIError(http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", fmt.Sprintf("request body must be at most %d bytes", routeLimit))
+			}
+			return err
+		}
+	}
+}
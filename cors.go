@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// parseCommaSeparatedList はカンマ区切りの一覧を読む。空要素は無視する
+func parseCommaSeparatedList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// corsMiddleware は許可したオリジンからのブラウザのリクエストを受け付ける
+// セッションCookieを使うのでcredentialsを許可する。そのため任意のオリジンを反映することはせず、一覧にないオリジンにはCORSヘッダを返さない
+func corsMiddleware(allowOrigins []string) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: allowOrigins,
+		AllowMethods: []string{
+			http.MethodGet,
+			http.MethodHead,
+			http.MethodPost,
+			http.MethodPut,
+			http.MethodPatch,
+			http.MethodDelete,
+		},
+		AllowHeaders: []string{
+			echo.HeaderContentType,
+			echo.HeaderIfModifiedSince,
+			"If-None-Match",
+			idempotencyKeyHeader,
+			requestIDHeader,
+		},
+		ExposeHeaders: []string{
+			"ETag",
+			echo.HeaderRetryAfter,
+			requestIDHeader,
+		},
+		AllowCredentials: true,
+		MaxAge:           600,
+	})
+}
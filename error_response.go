@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ErrorDetail struct {
+	// Code はクライアントが分岐に使える機械向けのコード (例: SLOT_FULL)
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// apiErrorCode はnewAPIErrorでecho.HTTPErrorのInternalに付けるエラーコード
+// errにはSetInternalで渡していた元のエラーを入れ、errors.Is/Asで辿れるようにする
+type apiErrorCode struct {
+	code string
+	err  error
+}
+
+func (e *apiErrorCode) Error() string {
+	if e.err == nil {
+		return e.code
+	}
+	return e.code + ": " + e.err.Error()
+}
+
+func (e *apiErrorCode) Unwrap() error {
+	return e.err
+}
+
+// newAPIError はエラーコード付きのecho.HTTPErrorを作る
+func newAPIError(status int, code, message string) *echo.HTTPError {
+	return newAPIErrorWithInternal(status, code, message, nil)
+}
+
+// newAPIErrorWithInternal はnewAPIErrorに加えて、原因となったエラーをInternalに含める
+func newAPIErrorWithInternal(status int, code, message string, internal error) *echo.HTTPError {
+	return echo.NewHTTPError(status, message).SetInternal(&apiErrorCode{code: code, err: internal})
+}
+
+// errorCodeRules はコードの付いていないエラーのメッセージからコードを決める規則。上から順に最初に一致したものを使う
+// 新しいエラーはここに足さず、newAPIErrorでコードを付けること
+var errorCodeRules = []struct {
+	status   int
+	contains []string
+	code     string
+}{
+	{http.StatusBadRequest, []string{"予約枠の境界と一致しません", "bad reservation time range", "end_at must be after start_at", "livestream must be at"}, "INVALID_RANGE"},
+	{http.StatusBadRequest, []string{"スパム判定"}, "NG_WORD"},
+	{http.StatusBadRequest, []string{"failed to decode the request body"}, "INVALID_JSON"},
+	{http.StatusBadRequest, []string{"in path must be", "query parameter"}, "INVALID_PARAMETER"},
+	{http.StatusBadRequest, []string{" must be a valid URL", " must be an http or https URL", " must be an absolute URL", " host is not allowed"}, "INVALID_URL"},
+	{http.StatusUnauthorized, []string{"session has expired"}, "SESSION_EXPIRED"},
+	{http.StatusUnauthorized, []string{"invalid username or password"}, "INVALID_CREDENTIALS"},
+	{http.StatusForbidden, []string{"other streamer's", "other user's", "that other streamers own"}, "NOT_OWNER"},
+	{http.StatusNotFound, []string{"not found livestream", "livestream not found"}, "LIVESTREAM_NOT_FOUND"},
+	{http.StatusNotFound, []string{"not found user", "user not found"}, "USER_NOT_FOUND"},
+	{http.StatusConflict, []string{"modified concurrently"}, "VERSION_CONFLICT"},
+	{http.StatusConflict, []string{"has already started"}, "ALREADY_STARTED"},
+	{http.StatusGone, []string{"reservation hold has expired"}, "HOLD_EXPIRED"},
+	{http.StatusTooManyRequests, []string{"too many reservations"}, "RATE_LIMITED"},
+	{http.StatusServiceUnavailable, []string{"request timed out"}, "TIMEOUT"},
+}
+
+// newErrorDetail はハンドラが返したエラーからステータスコードとエラー内容を求める
+// echo.HTTPError以外の想定外のエラーは、これまでどおり500とエラー文字列をそのまま返す
+func newErrorDetail(err error) (int, ErrorDetail) {
+	var he *echo.HTTPError
+	if !errors.As(err, &he) {
+		return http.StatusInternalServerError, ErrorDetail{Code: "INTERNAL_ERROR", Message: err.Error()}
+	}
+
+	message := fmt.Sprint(he.Message)
+	return he.Code, ErrorDetail{Code: errorCode(he, message), Message: message}
+}
+
+func errorCode(he *echo.HTTPError, message string) string {
+	var coded *apiErrorCode
+	if errors.As(he, &coded) {
+		return coded.code
+	}
+	for _, rule := range errorCodeRules {
+		if rule.status != he.Code {
+			continue
+		}
+		for _, s := range rule.contains {
+			if strings.Contains(message, s) {
+				return rule.code
+			}
+		}
+	}
+
+	// 個別のコードがなければステータスコードから決める
+	if he.Code >= http.StatusInternalServerError && he.Code != http.StatusServiceUnavailable {
+		return "INTERNAL_ERROR"
+	}
+	if text := http.StatusText(he.Code); text != "" {
+		return strings.ToUpper(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+	}
+	return "UNKNOWN"
+}
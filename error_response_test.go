@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestNewErrorDetailCode(t *testing.T) {
+	slotFull := newAPIErrorWithInternal(http.StatusBadRequest, "SLOT_FULL", "予約枠に空きがありません", errReservationSlotFull)
+	for _, tt := range []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "coded", err: newAPIError(http.StatusForbidden, "NOT_OWNER", "can't update other streamer's livestream"), wantStatus: http.StatusForbidden, wantCode: "NOT_OWNER"},
+		// 付けたコードはメッセージの文言より優先する
+		{name: "coded overrides message", err: newAPIError(http.StatusBadRequest, "INVALID_URL", "limit query parameter must be integer"), wantStatus: http.StatusBadRequest, wantCode: "INVALID_URL"},
+		{name: "coded with internal", err: slotFull, wantStatus: http.StatusBadRequest, wantCode: "SLOT_FULL"},
+		// 外側で包み直した場合は外側のコードを使う
+		{name: "wrapped", err: newAPIErrorWithInternal(http.StatusServiceUnavailable, "TIMEOUT", "request timed out, please retry later", slotFull), wantStatus: http.StatusServiceUnavailable, wantCode: "TIMEOUT"},
+		{name: "fallback rule", err: echo.NewHTTPError(http.StatusNotFound, "not found livestream"), wantStatus: http.StatusNotFound, wantCode: "LIVESTREAM_NOT_FOUND"},
+		{name: "fallback status", err: echo.NewHTTPError(http.StatusBadRequest, "something else"), wantStatus: http.StatusBadRequest, wantCode: "BAD_REQUEST"},
+		{name: "internal server error", err: echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: boom"), wantStatus: http.StatusInternalServerError, wantCode: "INTERNAL_ERROR"},
+		{name: "unexpected", err: errors.New("boom"), wantStatus: http.StatusInternalServerError, wantCode: "INTERNAL_ERROR"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			status, detail := newErrorDetail(tt.err)
+			if status != tt.wantStatus || detail.Code != tt.wantCode {
+				t.Errorf("newErrorDetail() = %d %s, want %d %s", status, detail.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+
+	// コードを付けても元のエラーは辿れる
+	if !errors.Is(slotFull, errReservationSlotFull) {
+		t.Error("errors.Is(slotFull, errReservationSlotFull) = false, want true")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/singleflight"
+)
+
+// sharedFill は同じIDに対して同時に行われるfillを1回にまとめる
+// fillはrunSharedReadOnlyの専用トランザクションで行うので、呼び出し元のトランザクションで書き込んだ内容は見えない
+type sharedFill struct {
+	kind  string
+	group singleflight.Group
+	// callsはfillの呼び出し数、executionsは実際にDBへ問い合わせた回数
+	calls      atomic.Uint64
+	executions atomic.Uint64
+}
+
+var (
+	livestreamFills = &sharedFill{kind: "livestream"}
+	userFills       = &sharedFill{kind: "user"}
+)
+
+// do は同じIDのfillが実行中ならその結果を共有する。待つのはctxが終わるまで
+func (f *sharedFill) do(ctx context.Context, id int64, fill func() (interface{}, error)) (interface{}, error) {
+	f.calls.Add(1)
+	ch := f.group.DoChan(strconv.FormatInt(id, 10), func() (interface{}, error) {
+		f.executions.Add(1)
+		return fill()
+	})
+	return waitShared(ctx, ch)
+}
+
+// writeSharedFillMetrics はfillの呼び出し数と実際の問い合わせ数をPrometheusのテキスト形式で書き出す
+func writeSharedFillMetrics(sb *strings.Builder) {
+	sb.WriteString("# HELP fill_calls_total Number of response fills requested.\n")
+	sb.WriteString("# TYPE fill_calls_total counter\n")
+	for _, f := range []*sharedFill{livestreamFills, userFills} {
+		fmt.Fprintf(sb, "fill_calls_total{kind=\"%s\"} %d\n", f.kind, f.calls.Load())
+	}
+	sb.WriteString("# HELP fill_executions_total Number of response fills that queried the database.\n")
+	sb.WriteString("# TYPE fill_executions_total counter\n")
+	for _, f := range []*sharedFill{livestreamFills, userFills} {
+		fmt.Fprintf(sb, "fill_executions_total{kind=\"%s\"} %d\n", f.kind, f.executions.Load())
+	}
+}
+
+// fillLivestreamResponseShared は同時に同じ配信をfillするリクエストとDBへの問い合わせを共有する
+// 自分のトランザクションで書き込みをしていない経路でのみ使うこと
+func fillLivestreamResponseShared(ctx context.Context, livestreamModel LivestreamModel) (Livestream, error) {
+	v, err := livestreamFills.do(ctx, livestreamModel.ID, func() (interface{}, error) {
+		var livestream Livestream
+		err := runSharedReadOnly(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			var err error
+			livestream, err = fillLivestreamResponse(ctx, tx, livestreamModel)
+			return err
+		})
+		return livestream, err
+	})
+	if err != nil {
+		return Livestream{}, err
+	}
+	// 他のリクエストと共有している結果なので、書き換えられるスライスは複製して返す
+	livestream := v.(Livestream)
+	livestream.Tags = append(make([]Tag, 0, len(livestream.Tags)), livestream.Tags...)
+	livestream.Owner = copyUser(livestream.Owner)
+	return livestream, nil
+}
+
+// fillUserResponseShared は同時に同じユーザをfillするリクエストとDBへの問い合わせを共有する
+// 自分のトランザクションで書き込みをしていない経路でのみ使うこと
+func fillUserResponseShared(ctx context.Context, userModel UserModel) (User, error) {
+	v, err := userFills.do(ctx, userModel.ID, func() (interface{}, error) {
+		var user User
+		err := runSharedReadOnly(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			var err error
+			user, err = fillUserResponse(ctx, tx, userModel)
+			return err
+		})
+		return user, err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return copyUser(v.(User)), nil
+}
+
+func copyUser(user User) User {
+	if user.Icon != nil {
+		user.Icon = append([]byte(nil), user.Icon...)
+	}
+	return user
+}
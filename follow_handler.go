@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type FollowModel struct {
+	ID         int64 `db:"id"`
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+}
+
+// フォローAPI
+// POST /api/user/:username/follow
+// フォロー済みでもエラーにはしない
+func followUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if followee.ID == userID {
+		return newAPIError(http.StatusBadRequest, "SELF_FOLLOW", "can't follow yourself")
+	}
+
+	followModel := FollowModel{
+		FollowerID: userID,
+		FolloweeID: followee.ID,
+		CreatedAt:  time.Now().Unix(),
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO follows (follower_id, followee_id, created_at) VALUES (:follower_id, :followee_id, :created_at)", followModel); err != nil && !isDuplicateEntryError(err) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロー解除API
+// DELETE /api/user/:username/follow
+// フォローしていなくてもエラーにはしない
+func unfollowUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee, err := getUserByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followee.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロー中の配信者の配信フィードAPI
+// GET /api/me/following/livestreams
+// ページングは配信フィードAPIと同じくafter_idで行う
+func getFollowingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, afterID, err := parseLivestreamFeedPage(c)
+	if err != nil {
+		return err
+	}
+
+	conditions := []string{"follows.follower_id = ?", "livestreams.is_archived = FALSE"}
+	args := []interface{}{userID}
+	if afterID != nil {
+		conditions = append(conditions, "livestreams.id < ?")
+		args = append(args, *afterID)
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []LivestreamModel
+	query := "SELECT livestreams.* FROM livestreams JOIN follows ON follows.followee_id = livestreams.user_id WHERE " + strings.Join(conditions, " AND ") + " ORDER BY livestreams.id DESC LIMIT ?"
+	if err := tx.SelectContext(ctx, &livestreamModels, query, append(args, limit)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newLivestreamFeedResponse(livestreamModels, livestreams, limit))
+}
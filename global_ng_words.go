@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type GlobalNGWordModel struct {
+	ID        int64  `db:"id"`
+	Word      string `db:"word"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type PostGlobalNGWordRequest struct {
+	Word string `json:"word"`
+}
+
+type GlobalNGWordsResponse struct {
+	Words []string `json:"words"`
+}
+
+// 他のインスタンスで追加されたNGワードがないか確かめる間隔
+const globalNGWordsCheckInterval = 5 * time.Second
+
+// globalNGWordList はすべての配信に適用するNGワード (global_ng_wordsテーブル) のオンメモリキャッシュ
+// 起動時に読み込み、管理者用APIで追加・読み直しを行う
+// 他のインスタンスでの追加は、runGlobalNGWordsWatcherがテーブルの世代の変化を見つけて読み直す
+type globalNGWordList struct {
+	mu sync.RWMutex
+	// words は登録順に並べた、小文字にしたNGワード
+	words []string
+	// original は表示用の登録時の表記
+	original []string
+	// generation は読み込んだ時点のテーブルの世代
+	generation globalNGWordsGeneration
+}
+
+// globalNGWordsGeneration はglobal_ng_wordsの最大IDと件数。追加や削除があれば変わる
+type globalNGWordsGeneration struct {
+	MaxID int64 `db:"max_id"`
+	Count int64 `db:"count"`
+}
+
+var globalNGWords = &globalNGWordList{}
+
+// reload はglobal_ng_wordsテーブルを読み直す
+func (l *globalNGWordList) reload(ctx context.Context) error {
+	var models []GlobalNGWordModel
+	if err := dbConn.SelectContext(ctx, &models, "SELECT * FROM global_ng_words ORDER BY id"); err != nil {
+		return err
+	}
+	words := make([]string, len(models))
+	original := make([]string, len(models))
+	generation := globalNGWordsGeneration{Count: int64(len(models))}
+	for i, model := range models {
+		words[i] = strings.ToLower(model.Word)
+		original[i] = model.Word
+		generation.MaxID = max(generation.MaxID, model.ID)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.words = words
+	l.original = original
+	l.generation = generation
+	return nil
+}
+
+// reloadIfChanged はテーブルの世代が読み込んだ時点から変わっていれば読み直す
+// 読み直した場合はtrueを返す
+func (l *globalNGWordList) reloadIfChanged(ctx context.Context) (bool, error) {
+	var generation globalNGWordsGeneration
+	if err := dbConn.GetContext(ctx, &generation, "SELECT COALESCE(MAX(id), 0) AS max_id, COUNT(*) AS count FROM global_ng_words"); err != nil {
+		return false, err
+	}
+	l.mu.RLock()
+	changed := generation != l.generation
+	l.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, l.reload(ctx)
+}
+
+// runGlobalNGWordsWatcher は定期的にglobal_ng_wordsの変化を確かめ、他のインスタンスでの追加を反映し続ける
+func runGlobalNGWordsWatcher(logger echo.Logger) {
+	ticker := time.NewTicker(globalNGWordsCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := globalNGWords.reloadIfChanged(context.Background())
+		if err != nil {
+			logger.Warnf("failed to check global ng words: %+v", err)
+			continue
+		}
+		if reloaded {
+			logger.Infof("reloaded global ng words")
+		}
+	}
+}
+
+// match はtextに含まれる最初のNGワードを返す。大文字小文字は区別しない
+func (l *globalNGWordList) match(text string) (string, bool) {
+	text = strings.ToLower(text)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i, word := range l.words {
+		if strings.Contains(text, word) {
+			return l.original[i], true
+		}
+	}
+	return "", false
+}
+
+func (l *globalNGWordList) list() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	words := make([]string, len(l.original))
+	copy(words, l.original)
+	return words
+}
+
+// グローバルNGワード追加API (管理者用)
+// POST /api/admin/ng-words
+// 追加したNGワードはこのインスタンスでは直後の投稿から効く。他のインスタンスでもglobalNGWordsCheckInterval以内に効く
+func postGlobalNGWordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostGlobalNGWordRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if strings.TrimSpace(req.Word) == "" {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "word must not be empty")
+	}
+
+	if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO global_ng_words (word, created_at) VALUES (:word, :created_at)", GlobalNGWordModel{
+		Word:      req.Word,
+		CreatedAt: time.Now().Unix(),
+	}); err != nil {
+		if isDuplicateEntryError(err) {
+			return newAPIError(http.StatusConflict, "NG_WORD_EXISTS", "ng word already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert global ng word: "+err.Error())
+	}
+	if err := globalNGWords.reload(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload global ng words: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, GlobalNGWordsResponse{Words: globalNGWords.list()})
+}
+
+// グローバルNGワード再読み込みAPI (管理者用)
+// POST /api/admin/ng-words/reload
+// テーブルの既存の行を直接書き換えた場合など、世代が変わらない変更を再起動せずに反映する
+func reloadGlobalNGWordsHandler(c echo.Context) error {
+	if err := globalNGWords.reload(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload global ng words: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, GlobalNGWordsResponse{Words: globalNGWords.list()})
+}
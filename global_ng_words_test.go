@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGlobalNGWordsReloadIfChangedPicksUpOtherInstances(t *testing.T) {
+	setupTestDB(t)
+
+	ctx := context.Background()
+	words := &globalNGWordList{}
+	if err := words.reload(ctx); err != nil {
+		t.Fatalf("failed to load global ng words: %+v", err)
+	}
+	if reloaded, err := words.reloadIfChanged(ctx); err != nil || reloaded {
+		t.Fatalf("reloadIfChanged() = %v, %v, want false without changes", reloaded, err)
+	}
+
+	// 他のインスタンスが追加した場合と同じく、テーブルにだけ書き込む
+	if _, err := dbConn.Exec("INSERT INTO global_ng_words (word, created_at) VALUES ('Spam', ?)", time.Now().Unix()); err != nil {
+		t.Fatalf("failed to insert global ng word: %+v", err)
+	}
+	if reloaded, err := words.reloadIfChanged(ctx); err != nil || !reloaded {
+		t.Fatalf("reloadIfChanged() = %v, %v, want true after insert", reloaded, err)
+	}
+	if word, ok := words.match("this is SPAM"); !ok || word != "Spam" {
+		t.Errorf("match() = %q, %v, want Spam", word, ok)
+	}
+
+	if _, err := dbConn.Exec("DELETE FROM global_ng_words"); err != nil {
+		t.Fatalf("failed to delete global ng words: %+v", err)
+	}
+	if reloaded, err := words.reloadIfChanged(ctx); err != nil || !reloaded {
+		t.Fatalf("reloadIfChanged() = %v, %v, want true after delete", reloaded, err)
+	}
+	if _, ok := words.match("this is SPAM"); ok {
+		t.Error("match() found a deleted word")
+	}
+}
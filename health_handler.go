@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DBへの疎通確認の待ち時間
+const healthCheckTimeout = 2 * time.Second
+
+// readiness API
+// GET /healthz
+// DBに接続できる場合のみ200を返す
+// ロードバランサから頻繁に叩かれるので、失敗してもエラーログは出さない
+func getHealthzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := dbConn.PingContext(ctx); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, &ErrorResponse{Error: ErrorDetail{Code: "DATABASE_UNAVAILABLE", Message: "database unavailable: " + err.Error()}})
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+// liveness API
+// GET /livez
+// プロセスが動いていれば常に200を返す
+func getLivezHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
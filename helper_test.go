@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// DBを使うテストの接続先 (未設定ならDBを使うテストはスキップする)
+// 例: ISUCON13_TEST_MYSQL_DSN='isucon:isucon@tcp(127.0.0.1:3306)/isupipe_test'
+const testMySQLDSNEnvKey = "ISUCON13_TEST_MYSQL_DSN"
+
+// setupTestDB はテスト用DBにsql/schema.sqlを流し直して、dbConnを差し替える
+// テストの終了時にキャッシュを捨てて元の接続に戻す
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv(testMySQLDSNEnvKey)
+	if dsn == "" {
+		t.Skipf("%s is not set", testMySQLDSNEnvKey)
+	}
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %+v", testMySQLDSNEnvKey, err)
+	}
+	conf.ParseTime = true
+	// schema.sqlをまとめて流すため
+	conf.MultiStatements = true
+
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		t.Fatalf("failed to open test db: %+v", err)
+	}
+	schema, err := os.ReadFile("sql/schema.sql")
+	if err != nil {
+		t.Fatalf("failed to read schema: %+v", err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %+v", err)
+	}
+
+	prevConn := dbConn
+	dbConn = db
+	t.Cleanup(func() {
+		preparedStmts.close()
+		tagsCache.invalidate()
+		dbConn = prevConn
+		db.Close()
+	})
+}
+
+// insertTestUser はテーマ付きのユーザを作ってIDを返す
+func insertTestUser(t *testing.T, name string) int64 {
+	t.Helper()
+
+	rs, err := dbConn.Exec("INSERT INTO users (name, display_name, password, description) VALUES (?, ?, '', '')", name, name)
+	if err != nil {
+		t.Fatalf("failed to insert user: %+v", err)
+	}
+	userID, err := rs.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get inserted user id: %+v", err)
+	}
+	if _, err := dbConn.Exec("INSERT INTO themes (user_id, dark_mode) VALUES (?, FALSE)", userID); err != nil {
+		t.Fatalf("failed to insert theme: %+v", err)
+	}
+	return userID
+}
+
+// insertTestLivestream は配信を作ってIDを返す。予約枠は消費しない
+func insertTestLivestream(t *testing.T, userID int64, title string, startAt, endAt int64) int64 {
+	t.Helper()
+
+	rs, err := dbConn.Exec("INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, created_at) VALUES (?, ?, '', '', '', ?, ?, ?)", userID, title, startAt, endAt, time.Now().Unix())
+	if err != nil {
+		t.Fatalf("failed to insert livestream: %+v", err)
+	}
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get inserted livestream id: %+v", err)
+	}
+	return livestreamID
+}
+
+// insertTestSlots はstartAtからendAtまで1時間ごとに、残りslot枠の予約枠を作る
+func insertTestSlots(t *testing.T, startAt, endAt, slot int64) {
+	t.Helper()
+
+	for at := startAt; at < endAt; at += 3600 {
+		if _, err := dbConn.Exec("INSERT INTO reservation_slots (slot, initial_slot, start_at, end_at) VALUES (?, ?, ?, ?)", slot, slot, at, at+3600); err != nil {
+			t.Fatalf("failed to insert reservation slot: %+v", err)
+		}
+	}
+}
+
+// newTestContext はuserIDでログインしたセッションのcookieを付けたリクエストのcontextを作る
+// userIDが0なら未ログインのリクエストにする
+func newTestContext(t *testing.T, method, target string, body io.Reader, userID int64) (echo.Context, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, body)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	store := sessions.NewCookieStore(secret)
+	if userID != 0 {
+		sess, err := store.New(httptest.NewRequest(method, target, nil), defaultSessionIDKey)
+		if err != nil {
+			t.Fatalf("failed to create session: %+v", err)
+		}
+		sess.Values[defaultUserIDKey] = userID
+		sess.Values[defaultSessionExpiresKey] = time.Now().Add(time.Hour).Unix()
+		w := httptest.NewRecorder()
+		if err := store.Save(req, w, sess); err != nil {
+			t.Fatalf("failed to save session: %+v", err)
+		}
+		for _, cookie := range w.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	// session.Middlewareと同じキーでストアを渡す
+	c.Set("_session_store", sessions.Store(store))
+	return c, rec
+}
+
+// responseStatus はハンドラが返したエラーか、書き込まれたレスポンスのステータスコードを返す
+func responseStatus(err error, rec *httptest.ResponseRecorder) int {
+	if err == nil {
+		return rec.Code
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type iconHashCacheEntry struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// iconHashCache はアイコン画像ファイルのsha256を、更新時刻とサイズが変わるまで保持する
+// アイコン取得のたびにファイル全体を読んでハッシュを計算しないようにする
+type iconHashCache struct {
+	mu      sync.Mutex
+	entries map[string]iconHashCacheEntry
+}
+
+var iconHashes = &iconHashCache{entries: make(map[string]iconHashCacheEntry)}
+
+// hash はfのハッシュを返す。infoはfのStatの結果
+// 計算した場合はfを読み進めるので、先頭に戻してから返す
+func (ic *iconHashCache) hash(filename string, f *os.File, info os.FileInfo) (string, error) {
+	ic.mu.Lock()
+	entry, ok := ic.entries[filename]
+	ic.mu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.hash, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+
+	ic.mu.Lock()
+	ic.entries[filename] = iconHashCacheEntry{modTime: info.ModTime(), size: info.Size(), hash: hash}
+	ic.mu.Unlock()
+	return hash, nil
+}
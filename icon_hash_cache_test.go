@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIconHashCacheReusesHashUntilFileChanges(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "icon")
+	modTime := time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	ic := &iconHashCache{entries: make(map[string]iconHashCacheEntry)}
+	writeIcon := func(image string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(filename, []byte(image), 0o600); err != nil {
+			t.Fatalf("failed to write icon: %+v", err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatalf("failed to set icon mtime: %+v", err)
+		}
+	}
+	hashIcon := func() string {
+		t.Helper()
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("failed to open icon: %+v", err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatalf("failed to stat icon: %+v", err)
+		}
+		hash, err := ic.hash(filename, f, info)
+		if err != nil {
+			t.Fatalf("failed to hash icon: %+v", err)
+		}
+		// 返した後もファイルは先頭から読める
+		buf := make([]byte, 1)
+		if _, err := f.Read(buf); err != nil {
+			t.Fatalf("failed to read icon after hashing: %+v", err)
+		}
+		return hash
+	}
+	sum := func(image string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(image))) }
+
+	writeIcon("icon-a", modTime)
+	if got := hashIcon(); got != sum("icon-a") {
+		t.Fatalf("hash = %s, want %s", got, sum("icon-a"))
+	}
+
+	// 更新時刻とサイズが同じなら読み直さない
+	writeIcon("icon-b", modTime)
+	if got := hashIcon(); got != sum("icon-a") {
+		t.Errorf("hash = %s, want the cached %s", got, sum("icon-a"))
+	}
+
+	writeIcon("icon-b", modTime.Add(time.Second))
+	if got := hashIcon(); got != sum("icon-b") {
+		t.Errorf("hash = %s, want %s", got, sum("icon-b"))
+	}
+}
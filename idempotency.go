@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// 同じキーでのリクエストを同一とみなす期間
+	idempotencyKeyTTL = 24 * time.Hour
+	// reservation_idempotency_keys.idempotency_key のカラム長
+	maxIdempotencyKeyLength = 255
+)
+
+type ReservationIdempotencyKeyModel struct {
+	ID             int64  `db:"id"`
+	UserID         int64  `db:"user_id"`
+	IdempotencyKey string `db:"idempotency_key"`
+	// LivestreamID はキャンセル待ちに入った予約では、繰り上がるまで0
+	LivestreamID int64 `db:"livestream_id"`
+	// WaitlistID はキャンセル待ちに入った予約のキャンセル待ちID。繰り上がるとNULLになる
+	WaitlistID sql.NullInt64 `db:"waitlist_id"`
+	CreatedAt  int64         `db:"created_at"`
+}
+
+// findIdempotentReservation は同じユーザが同じキーで予約済みの配信か、入ったキャンセル待ちを探す
+// 期限切れのキーや、配信・キャンセル待ちが消えているキーは削除して見つからなかったものとして扱う
+// 同じキーでの同時リクエストを直列化するため、ロックを取って読む
+func findIdempotentReservation(ctx context.Context, tx *sqlx.Tx, userID int64, key string, now time.Time) (LivestreamModel, *ReservationWaitlistEntry, bool, error) {
+	var keyModel ReservationIdempotencyKeyModel
+	if err := tx.GetContext(ctx, &keyModel, "SELECT * FROM reservation_idempotency_keys WHERE user_id = ? AND idempotency_key = ? FOR UPDATE", userID, key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, nil, false, nil
+		}
+		return LivestreamModel{}, nil, false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get idempotency key: "+err.Error()).SetInternal(err)
+	}
+
+	if keyModel.CreatedAt > now.Add(-idempotencyKeyTTL).Unix() {
+		if keyModel.WaitlistID.Valid {
+			var waitlistModel ReservationWaitlistModel
+			err := tx.GetContext(ctx, &waitlistModel, "SELECT * FROM reservation_waitlist WHERE id = ?", keyModel.WaitlistID.Int64)
+			if err == nil {
+				entry, err := waitlistEntry(ctx, tx, waitlistModel)
+				if err != nil {
+					return LivestreamModel{}, nil, false, err
+				}
+				return LivestreamModel{}, &entry, true, nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return LivestreamModel{}, nil, false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error()).SetInternal(err)
+			}
+		} else {
+			var livestreamModel LivestreamModel
+			err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", keyModel.LivestreamID)
+			if err == nil {
+				return livestreamModel, nil, true, nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return LivestreamModel{}, nil, false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_idempotency_keys WHERE id = ?", keyModel.ID); err != nil {
+		return LivestreamModel{}, nil, false, echo.NewHTTPError(http.StatusInternalServerError, "failed to delete idempotency key: "+err.Error()).SetInternal(err)
+	}
+	return LivestreamModel{}, nil, false, nil
+}
+
+// saveIdempotencyKey はキーと予約した配信を紐付けて保存する
+func saveIdempotencyKey(ctx context.Context, tx *sqlx.Tx, userID int64, key string, livestreamID int64, now time.Time) error {
+	return insertIdempotencyKey(ctx, tx, ReservationIdempotencyKeyModel{
+		UserID:         userID,
+		IdempotencyKey: key,
+		LivestreamID:   livestreamID,
+		CreatedAt:      now.Unix(),
+	})
+}
+
+// saveWaitlistIdempotencyKey はキーと入ったキャンセル待ちを紐付けて保存する
+// 再送で同じ予約がキャンセル待ちに何度も入り、繰り上げで配信が複数できるのを防ぐ
+func saveWaitlistIdempotencyKey(ctx context.Context, tx *sqlx.Tx, userID int64, key string, waitlistID int64, now time.Time) error {
+	return insertIdempotencyKey(ctx, tx, ReservationIdempotencyKeyModel{
+		UserID:         userID,
+		IdempotencyKey: key,
+		WaitlistID:     sql.NullInt64{Int64: waitlistID, Valid: true},
+		CreatedAt:      now.Unix(),
+	})
+}
+
+func insertIdempotencyKey(ctx context.Context, tx *sqlx.Tx, keyModel ReservationIdempotencyKeyModel) error {
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_idempotency_keys (user_id, idempotency_key, livestream_id, waitlist_id, created_at) VALUES (:user_id, :idempotency_key, :livestream_id, :waitlist_id, :created_at)", keyModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert idempotency key: "+err.Error()).SetInternal(err)
+	}
+	return nil
+}
+
+// purgeExpiredIdempotencyKeys は期限切れのキーをまとめて削除する
+func purgeExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM reservation_idempotency_keys WHERE created_at <= ?", now.Add(-idempotencyKeyTTL).Unix())
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var livecommentsCSVHeader = []string{"id", "user_name", "comment", "tip", "created_at"}
+
+// escapeCSVFormula は表計算ソフトで数式として解釈される文字で始まるセルの先頭に ' を付ける
+// ユーザが入力した値をそのまま出すと、CSVを開いた配信者の環境で数式が実行されてしまう
+func escapeCSVFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// ライブコメントCSV出力API (配信者向け)
+// GET /api/livestream/:livestream_id/livecomments.csv
+// 配信のライブコメントを古い順にCSVで返す。全件をメモリに載せないよう、1行ずつレスポンスに書き出す
+// セッション、配信の存在、配信者本人であることはミドルウェアで確認済み
+func exportLivecommentsCSVHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamModel := livestreamFromContext(c)
+
+	rows, err := dbConn.QueryxContext(ctx, `
+	SELECT
+		livecomments.id,
+		users.name,
+		livecomments.comment,
+		livecomments.tip,
+		livecomments.created_at
+	FROM
+		livecomments
+		JOIN users ON users.id = livecomments.user_id
+	WHERE
+		livecomments.livestream_id = ?
+	ORDER BY
+		livecomments.id
+	`, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="livestream-%d-livecomments.csv"`, livestreamModel.ID))
+	res.WriteHeader(http.StatusOK)
+
+	// 書き出し始めた後はステータスコードを変えられないので、失敗はログに残して打ち切る
+	w := csv.NewWriter(res)
+	if err := w.Write(livecommentsCSVHeader); err != nil {
+		c.Logger().Warnf("failed to write livecomments csv: %+v", err)
+		return nil
+	}
+	for rows.Next() {
+		var (
+			id        int64
+			userName  string
+			comment   string
+			tip       int64
+			createdAt int64
+		)
+		if err := rows.Scan(&id, &userName, &comment, &tip, &createdAt); err != nil {
+			c.Logger().Warnf("failed to scan livecomment: %+v", err)
+			return nil
+		}
+		record := []string{
+			strconv.FormatInt(id, 10),
+			escapeCSVFormula(userName),
+			escapeCSVFormula(comment),
+			strconv.FormatInt(tip, 10),
+			strconv.FormatInt(createdAt, 10),
+		}
+		if err := w.Write(record); err != nil {
+			c.Logger().Warnf("failed to write livecomments csv: %+v", err)
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Warnf("failed to iterate livecomments: %+v", err)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		c.Logger().Warnf("failed to write livecomments csv: %+v", err)
+	}
+	return nil
+}
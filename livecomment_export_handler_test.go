@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestEscapeCSVFormula(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: ""},
+		{in: "hello", want: "hello"},
+		{in: "a=b", want: "a=b"},
+		{in: "=HYPERLINK(\"http://example.com\")", want: "'=HYPERLINK(\"http://example.com\")"},
+		{in: "+1+1", want: "'+1+1"},
+		{in: "-1+1", want: "'-1+1"},
+		{in: "@SUM(A1)", want: "'@SUM(A1)"},
+		{in: "\t=1", want: "'\t=1"},
+		{in: "こんにちは", want: "こんにちは"},
+	} {
+		if got := escapeCSVFormula(tt.in); got != tt.want {
+			t.Errorf("escapeCSVFormula(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
 )
 
 type PostLivecommentRequest struct {
@@ -75,10 +77,10 @@ func getLivecommentsHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -88,7 +90,7 @@ func getLivecommentsHandler(c echo.Context) error {
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be integer")
 		}
 		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
@@ -133,10 +135,10 @@ func getNgwords(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -168,7 +170,7 @@ func postLivecommentHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
 	// error already checked
@@ -178,7 +180,7 @@ func postLivecommentHandler(c echo.Context) error {
 
 	var req *PostLivecommentRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -190,32 +192,40 @@ func postLivecommentHandler(c echo.Context) error {
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "livestream not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
 
 	// スパム判定
+	// 全配信共通のNGワードと、配信者が登録したNGワードを大文字小文字を区別せず部分一致で調べる
+	// 配信者のNGワードは投稿と同じトランザクションで引くので、直前に登録されたものもすぐに効く
+	if word, ok := globalNGWords.match(req.Comment); ok {
+		c.Logger().Infof("[hitGlobalSpam] comment = %s", req.Comment)
+		return newAPIError(http.StatusBadRequest, "NG_WORD", fmt.Sprintf("このコメントがスパム判定されました (NGワード: %s)", word))
+	}
 	{
-		var hitSpam int
+		var hitWords []string
 		query := `
 		SELECT
-			COUNT(*)
+			ng_words.word
 		FROM
 			(SELECT ? AS text) AS texts
 			INNER JOIN ng_words
 				ON
 					ng_words.user_id = ?
 					AND ng_words.livestream_id = ?
-					AND texts.text LIKE CONCAT('%', ng_words.word, '%')
+					AND LOWER(texts.text) LIKE CONCAT('%', LOWER(ng_words.word), '%')
+		ORDER BY ng_words.id
+		LIMIT 1
 		`
-		if err := tx.GetContext(ctx, &hitSpam, query, req.Comment, livestreamModel.UserID, livestreamModel.ID); err != nil {
+		if err := tx.SelectContext(ctx, &hitWords, query, req.Comment, livestreamModel.UserID, livestreamModel.ID); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
 		}
-		c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
-		if hitSpam >= 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+		c.Logger().Infof("[hitSpam=%d] comment = %s", len(hitWords), req.Comment)
+		if len(hitWords) >= 1 {
+			return newAPIError(http.StatusBadRequest, "NG_WORD", fmt.Sprintf("このコメントがスパム判定されました (NGワード: %s)", hitWords[0]))
 		}
 	}
 
@@ -238,6 +248,10 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
 	}
 	livecommentModel.ID = livecommentID
+	// コメント数が変わるので検索のETagを変える
+	if err := touchLivestream(ctx, tx, livecommentModel.LivestreamID); err != nil {
+		return err
+	}
 
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
@@ -248,9 +262,46 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	livecommentPubSub.publish(livecomment.Livestream.ID, livecomment)
+
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
+// ライブコメント購読API (WebSocket)
+// GET /api/livestream/:livestream_id/ws
+// 接続中に投稿されたライブコメントをJSONで1件ずつpushする
+// セッションと配信の存在はsessionMiddleware, livestreamMiddlewareで確認済みなので、存在しない配信はupgrade前に404になる
+func livecommentWebSocketHandler(c echo.Context) error {
+	livestreamID := livestreamFromContext(c).ID
+
+	livecomments, unsubscribe := livecommentPubSub.subscribe(livestreamID)
+	defer unsubscribe()
+
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		// クライアントからのメッセージは使わないが、切断の検知のために読み続ける
+		disconnected := make(chan struct{})
+		go func() {
+			defer close(disconnected)
+			io.Copy(io.Discard, ws)
+		}()
+
+		for {
+			select {
+			case <-disconnected:
+				return
+			case livecomment := <-livecomments:
+				if err := websocket.JSON.Send(ws, livecomment); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -260,12 +311,12 @@ func reportLivecommentHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
 	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livecomment_id in path must be integer")
 	}
 
 	// error already checked
@@ -282,7 +333,7 @@ func reportLivecommentHandler(c echo.Context) error {
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "livestream not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
@@ -291,7 +342,7 @@ func reportLivecommentHandler(c echo.Context) error {
 	var livecommentModel LivecommentModel
 	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+			return newAPIError(http.StatusNotFound, "LIVECOMMENT_NOT_FOUND", "livecomment not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
 		}
@@ -336,7 +387,7 @@ func moderateHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
 	// error already checked
@@ -346,7 +397,7 @@ func moderateHandler(c echo.Context) error {
 
 	var req *ModerateRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -356,12 +407,16 @@ func moderateHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
 	}
-	if len(ownedLivestreams) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "A streamer can't moderate livestreams that other streamers own")
 	}
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
@@ -379,35 +434,28 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
 	}
 
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
-	}
-
 	// NGワードにヒットする過去の投稿も全削除する
-	for _, ngword := range ngwords {
-		// ライブコメント一覧取得
-		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments"); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
-		}
-
-		for _, livecomment := range livecomments {
-			query := `
-			DELETE FROM livecomments
-			WHERE
-			id = ? AND
-			livestream_id = ? AND
-			(SELECT COUNT(*)
-			FROM
-			(SELECT ? AS text) AS texts
-			INNER JOIN
-			(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-			ON texts.text LIKE patterns.pattern) >= 1;
-			`
-			if _, err := tx.ExecContext(ctx, query, livecomment.ID, livestreamID, livecomment.Comment, ngword.Word); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
-			}
+	// 大文字小文字を区別せず、部分一致で判定する
+	query := `
+	DELETE livecomments
+	FROM
+		livecomments
+		INNER JOIN ng_words ON ng_words.livestream_id = livecomments.livestream_id
+	WHERE
+		livecomments.livestream_id = ?
+		AND LOWER(livecomments.comment) LIKE CONCAT('%', LOWER(ng_words.word), '%')
+	`
+	deleteResult, err := tx.ExecContext(ctx, query, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+	}
+	deletedCount, err := deleteResult.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted livecomments count: "+err.Error())
+	}
+	if deletedCount > 0 {
+		if err := touchLivestream(ctx, tx, int64(livestreamID)); err != nil {
+			return err
 		}
 	}
 
@@ -416,7 +464,8 @@ func moderateHandler(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
+		"word_id":       wordID,
+		"deleted_count": deletedCount,
 	})
 }
 
@@ -478,3 +527,72 @@ func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel
 	}
 	return report, nil
 }
+
+// fillLivecommentReportResponses は同じ配信への通報をまとめて組み立てる
+// 通報者・コメント・コメント投稿者はそれぞれまとめて取得し、配信は1回だけ埋める
+// コメントが見つからない通報は結果から除く (削除済みのコメントへの通報は呼び出し側のクエリで除いておくこと)
+func fillLivecommentReportResponses(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, reportModels []LivecommentReportModel) ([]LivecommentReport, error) {
+	reports := make([]LivecommentReport, 0, len(reportModels))
+	if len(reportModels) == 0 {
+		return reports, nil
+	}
+
+	livecommentIDs := make([]int64, len(reportModels))
+	for i := range reportModels {
+		livecommentIDs[i] = reportModels[i].LivecommentID
+	}
+	var livecommentModels []LivecommentModel
+	query, params, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &livecommentModels, query, params...); err != nil {
+		return nil, err
+	}
+	livecommentMap := make(map[int64]LivecommentModel, len(livecommentModels))
+	for _, livecommentModel := range livecommentModels {
+		livecommentMap[livecommentModel.ID] = livecommentModel
+	}
+
+	userIDSet := make(map[int64]struct{})
+	for _, reportModel := range reportModels {
+		userIDSet[reportModel.UserID] = struct{}{}
+	}
+	for _, livecommentModel := range livecommentModels {
+		userIDSet[livecommentModel.UserID] = struct{}{}
+	}
+	userIDs := make([]int64, 0, len(userIDSet))
+	for userID := range userIDSet {
+		userIDs = append(userIDs, userID)
+	}
+	userMap, err := getUserMap(ctx, tx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reportModel := range reportModels {
+		livecommentModel, ok := livecommentMap[reportModel.LivecommentID]
+		if !ok {
+			continue
+		}
+		reports = append(reports, LivecommentReport{
+			ID:       reportModel.ID,
+			Reporter: userMap[reportModel.UserID],
+			Livecomment: Livecomment{
+				ID:         livecommentModel.ID,
+				User:       userMap[livecommentModel.UserID],
+				Livestream: livestream,
+				Comment:    livecommentModel.Comment,
+				Tip:        livecommentModel.Tip,
+				CreatedAt:  livecommentModel.CreatedAt,
+			},
+			CreatedAt: reportModel.CreatedAt,
+		})
+	}
+	return reports, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetLivecommentReportsUnknownLivestream(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/9999/report", nil, userID)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues("9999")
+	err := sessionMiddleware(livestreamMiddleware(livestreamOwnerMiddleware(getLivecommentReportsHandler)))(c)
+	if status := responseStatus(err, rec); status != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestLivecommentWebSocketUnknownLivestream(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "viewer")
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/9999/ws", nil, userID)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues("9999")
+	err := sessionMiddleware(livestreamMiddleware(livecommentWebSocketHandler))(c)
+	if status := responseStatus(err, rec); status != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestGetLivecommentReportsSkipsDeletedCommentsBeforeLimit(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	reporterID := insertTestUser(t, "reporter")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, ownerID, "live", now-60, now+3600)
+
+	var livecommentIDs []int64
+	for i := 0; i < 3; i++ {
+		rs, err := dbConn.Exec("INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, 'spam', 0, ?)", ownerID, livestreamID, now)
+		if err != nil {
+			t.Fatalf("failed to insert livecomment: %+v", err)
+		}
+		livecommentID, err := rs.LastInsertId()
+		if err != nil {
+			t.Fatalf("failed to get inserted livecomment id: %+v", err)
+		}
+		livecommentIDs = append(livecommentIDs, livecommentID)
+		if _, err := dbConn.Exec("INSERT INTO livecomment_reports (user_id, livestream_id, livecomment_id, created_at) VALUES (?, ?, ?, ?)", reporterID, livestreamID, livecommentID, now); err != nil {
+			t.Fatalf("failed to insert report: %+v", err)
+		}
+	}
+	// 最新の通報のコメントを削除しても、limit件返る
+	if _, err := dbConn.Exec("DELETE FROM livecomments WHERE id = ?", livecommentIDs[2]); err != nil {
+		t.Fatalf("failed to delete livecomment: %+v", err)
+	}
+
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/"+strconv.FormatInt(livestreamID, 10)+"/report?limit=2", nil, ownerID)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+	err := sessionMiddleware(livestreamMiddleware(livestreamOwnerMiddleware(getLivecommentReportsHandler)))(c)
+	if status := responseStatus(err, rec); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	var reports []LivecommentReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	for i, want := range []int64{livecommentIDs[1], livecommentIDs[0]} {
+		if reports[i].Livecomment.ID != want {
+			t.Errorf("reports[%d].livecomment.id = %d, want %d", i, reports[i].Livecomment.ID, want)
+		}
+	}
+}
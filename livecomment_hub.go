@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+)
+
+// 購読者ごとのバッファ。溢れた分は捨てて配信者側の投稿をブロックしない
+const livecommentSubscriberBufferSize = 64
+
+// livecommentHub はライブ配信ごとに新着ライブコメントを購読者へ配る
+type livecommentHub struct {
+	mu sync.RWMutex
+	// livestream_id -> 購読者のchannel集合
+	subscribers map[int64]map[chan Livecomment]struct{}
+}
+
+var livecommentPubSub = &livecommentHub{
+	subscribers: map[int64]map[chan Livecomment]struct{}{},
+}
+
+// subscribe はライブ配信の新着ライブコメントを受け取るchannelと、購読解除関数を返す
+func (h *livecommentHub) subscribe(livestreamID int64) (<-chan Livecomment, func()) {
+	ch := make(chan Livecomment, livecommentSubscriberBufferSize)
+
+	h.mu.Lock()
+	subs, ok := h.subscribers[livestreamID]
+	if !ok {
+		subs = map[chan Livecomment]struct{}{}
+		h.subscribers[livestreamID] = subs
+	}
+	subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			subs := h.subscribers[livestreamID]
+			delete(subs, ch)
+			if len(subs) == 0 {
+				delete(h.subscribers, livestreamID)
+			}
+		})
+	}
+	return ch, unsubscribe
+}
+
+// publish はライブコメントを購読者へ配る
+// 受信が追いつかない購読者の分は捨てる
+func (h *livecommentHub) publish(livestreamID int64, livecomment Livecomment) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.subscribers[livestreamID] {
+		select {
+		case ch <- livecomment:
+		default:
+		}
+	}
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
-	"os"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
+	// tzで指定されたタイムゾーンを、OSにタイムゾーンデータがない環境でも読めるようにする
+	_ "time/tzdata"
+	"unicode/utf8"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -25,6 +32,8 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// Waitlist がtrueなら、予約枠に空きがないときにキャンセル待ちに入る
+	Waitlist bool `json:"waitlist"`
 }
 
 type LivestreamViewerModel struct {
@@ -42,6 +51,25 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	// CreatedAt は予約した日時 (カラム追加前の配信は0)
+	CreatedAt  int64 `db:"created_at" json:"created_at"`
+	IsArchived bool  `db:"is_archived" json:"is_archived"`
+	// 検索で users/icons を引かずに済むよう、配信者の情報を複製して持つ
+	// 配信者の変更・アイコン変更時に更新する
+	OwnerName        string `db:"owner_name" json:"-"`
+	OwnerDisplayName string `db:"owner_display_name" json:"-"`
+	OwnerIconHash    string `db:"owner_icon_hash" json:"-"`
+	// Version は更新・譲渡のたびに1増える。同時に編集された場合の衝突検出に使う
+	Version int64 `db:"version" json:"version"`
+	// CurrentViewers は視聴中のユーザ数。入退室のたびにlivestream_viewers_historyと同じトランザクションで増減する
+	CurrentViewers int64 `db:"current_viewers" json:"current_viewers"`
+	// ReactionsCount はリアクションの総数。投稿のたびにreactionsへのINSERTと同じトランザクションで増やす
+	ReactionsCount int64 `db:"reactions_count" json:"reactions_count"`
+	// PeakViewers は同時視聴者数の最大値。current_viewersと同じUPDATEで更新する
+	PeakViewers int64 `db:"peak_viewers" json:"peak_viewers"`
+	// UpdatedAt は行が変わるたびにMySQLが進める更新日時。検索のETagに使う
+	// DSNのparseTimeによらず読めるよう、mysql.NullTimeで受ける
+	UpdatedAt mysql.NullTime `db:"updated_at" json:"-"`
 }
 
 type Livestream struct {
@@ -54,6 +82,87 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	CreatedAt    int64  `json:"created_at"`
+	IsArchived   bool   `json:"is_archived"`
+	// ViewersCount は現在視聴中(enterしてexitしていない)のユーザ数
+	ViewersCount int64 `json:"viewers_count"`
+	// CommentsCount は配信中に限らずこれまでに投稿されたライブコメントの総数
+	// モデレーションで削除されたものは含まない
+	CommentsCount int64 `json:"comments_count"`
+	// ReactionsCount はこれまでに投稿されたリアクションの総数
+	ReactionsCount int64 `json:"reactions_count"`
+	// State はリクエスト時点での配信の状態 (scheduled, live, ended)
+	State  string `json:"state"`
+	IsLive bool   `json:"is_live"`
+	// Version は更新・譲渡時にversionとして渡すと、その間に他で変更されていれば409になる
+	Version int64 `json:"version"`
+}
+
+const (
+	livestreamStateScheduled = "scheduled"
+	livestreamStateLive      = "live"
+	livestreamStateEnded     = "ended"
+)
+
+// livestreamState はnow時点での配信の状態を返す
+// start_atちょうどから配信中、end_atちょうどで終了とする
+func livestreamState(startAt, endAt int64, now time.Time) string {
+	switch t := now.Unix(); {
+	case t < startAt:
+		return livestreamStateScheduled
+	case t < endAt:
+		return livestreamStateLive
+	default:
+		return livestreamStateEnded
+	}
+}
+
+// LivestreamOwnerSummary はlight=1の検索で返す配信者情報
+type LivestreamOwnerSummary struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	IconHash    string `json:"icon_hash"`
+}
+
+// LightLivestream はOwnerだけを軽量なものに差し替えた配信
+// 埋め込んだLivestreamのOwnerはこちらのOwnerで隠される
+type LightLivestream struct {
+	Livestream
+	Owner LivestreamOwnerSummary `json:"owner"`
+}
+
+// PartialLivestream はexpandやfields=no_ownerで一部を省いて返す配信
+// 展開しなかった "owner" や "tags" はキーそのものを含まず、それ以外はLivestreamと同じ形になる
+type PartialLivestream struct {
+	Livestream
+	Owner *User  `json:"owner,omitempty"`
+	Tags  *[]Tag `json:"tags,omitempty"`
+}
+
+type ArchiveLivestreamRequest struct {
+	// IsArchived を省略した場合はアーカイブする
+	IsArchived *bool `json:"is_archived"`
+}
+
+type UpdateLivestreamRequest struct {
+	Title        string  `json:"title"`
+	Description  string  `json:"description"`
+	ThumbnailUrl string  `json:"thumbnail_url"`
+	Tags         []int64 `json:"tags"`
+	// Version を指定した場合、現在のversionと異なれば409を返す
+	Version *int64 `json:"version"`
+}
+
+type TransferLivestreamRequest struct {
+	Username string `json:"username"`
+	// Version を指定した場合、現在のversionと異なれば409を返す
+	Version *int64 `json:"version"`
+}
+
+type CloneLivestreamRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
 }
 
 type LivestreamTagModel struct {
@@ -63,12 +172,21 @@ type LivestreamTagModel struct {
 }
 
 type ReservationSlotModel struct {
-	ID      int64 `db:"id" json:"id"`
-	Slot    int64 `db:"slot" json:"slot"`
-	StartAt int64 `db:"start_at" json:"start_at"`
-	EndAt   int64 `db:"end_at" json:"end_at"`
+	ID   int64 `db:"id" json:"id"`
+	Slot int64 `db:"slot" json:"slot"`
+	// InitialSlot は予約が1件もないときの残数。初期データの投入時に決まり、管理者が予約枠を増減したときにslotと一緒に変わる
+	InitialSlot int64 `db:"initial_slot" json:"initial_slot"`
+	StartAt     int64 `db:"start_at" json:"start_at"`
+	EndAt       int64 `db:"end_at" json:"end_at"`
 }
 
+// 配信予約が可能な期間 (2023/11/25 10:00 JSTからの１年間)
+// start_at/end_atはタイムゾーンによらないunix秒なので、比較は常にこの時刻とunix秒同士で行う
+var (
+	reservationTermStartAt = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	reservationTermEndAt   = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
+)
+
 func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
@@ -83,65 +201,382 @@ func reserveLivestreamHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	if ok, retryAfter := reservationRateLimiter.allow(userID, time.Now()); !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return newAPIError(http.StatusTooManyRequests, "RATE_LIMITED", "too many reservations")
+	}
+
+	loc, err := parseReservationTimezone(c)
+	if err != nil {
+		return err
+	}
+
 	var req *ReserveLivestreamRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if err := validateLivestreamText(req.Title, req.Description); err != nil {
+		return err
+	}
+	if err := normalizeReservationURLs(req); err != nil {
+		return err
+	}
+	if err := validateReservationDuration(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+	if err := validateReservationTerm(req.StartAt, req.EndAt, loc); err != nil {
+		return err
+	}
+
+	// 同じキーでの再送には、新たに予約せず最初の予約結果を返す
+	idempotencyKey := c.Request().Header.Get(idempotencyKeyHeader)
+	if utf8.RuneCountInString(idempotencyKey) > maxIdempotencyKeyLength {
+		return newAPIError(http.StatusBadRequest, "INVALID_IDEMPOTENCY_KEY", fmt.Sprintf("%s header must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+	}
+
+	// 重なる予約枠を並列に予約するとデッドロックしうるので、トランザクションごとやり直す
+	var (
+		livestream Livestream
+		waitlisted *ReservationWaitlistEntry
+	)
+	err = retryOnLockConflict(ctx, c.Logger(), func() error {
+		var err error
+		livestream, waitlisted, err = reserveLivestream(ctx, c.Logger(), userID, req, idempotencyKey)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
+	// 予約枠に空きがなくキャンセル待ちに入った
+	if waitlisted != nil {
+		return c.JSON(http.StatusAccepted, waitlisted)
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// reserveLivestream は1回分のトランザクションで配信を予約する
+// デッドロック時にやり直せるよう、トランザクションの開始からコミットまでをここで完結させる
+// idempotencyKeyが空でなければ、同じキーで予約済みの配信か入ったキャンセル待ちがあればそれを返す
+// req.Waitlistがtrueで予約枠に空きがなければ、配信の代わりにキャンセル待ちの情報を返す
+func reserveLivestream(ctx context.Context, logger echo.Logger, userID int64, req *ReserveLivestreamRequest, idempotencyKey string) (Livestream, *ReservationWaitlistEntry, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
+	now := time.Now()
+	if idempotencyKey != "" {
+		// 同じキーで同時に来たリクエストは、片方がデッドロックでやり直しになり、やり直し時にはこちらで見つかる
+		livestreamModel, waitlisted, found, err := findIdempotentReservation(ctx, tx, userID, idempotencyKey, now)
+		if err != nil {
+			return Livestream{}, nil, err
+		}
+		if found && waitlisted != nil {
+			if err := tx.Commit(); err != nil {
+				return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+			}
+			return Livestream{}, waitlisted, nil
+		}
+		if found {
+			livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+			if err != nil {
+				return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+			}
+			return livestream, nil, nil
+		}
+	}
+
+	tagIDs, err := validateTagIDs(ctx, tx, req.Tags)
+	if err != nil {
+		return Livestream{}, nil, err
+	}
+
+	if err := reserveSlots(ctx, logger, tx, req.StartAt, req.EndAt); err != nil {
+		if !req.Waitlist || !errors.Is(err, errReservationSlotFull) {
+			return Livestream{}, nil, err
+		}
+		entry, err := enqueueWaitlist(ctx, tx, userID, req, now)
+		if err != nil {
+			return Livestream{}, nil, err
+		}
+		if idempotencyKey != "" {
+			if err := saveWaitlistIdempotencyKey(ctx, tx, userID, idempotencyKey, entry.ID, now); err != nil {
+				return Livestream{}, nil, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+		}
+		return Livestream{}, &entry, nil
+	}
+
+	livestreamModel := &LivestreamModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		CreatedAt:    now.Unix(),
+	}
+	if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+		return Livestream{}, nil, err
+	}
+
+	if idempotencyKey != "" {
+		if err := saveIdempotencyKey(ctx, tx, userID, idempotencyKey, livestreamModel.ID, now); err != nil {
+			return Livestream{}, nil, err
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Livestream{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+	}
+
+	return livestream, nil, nil
+}
+
+// 配信複製API
+// POST /api/livestream/:livestream_id/clone
+// 自分の配信のタイトル・説明・URL・タグをそのままに、別の時間帯で予約し直す
+func cloneLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if ok, retryAfter := reservationRateLimiter.allow(userID, time.Now()); !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return newAPIError(http.StatusTooManyRequests, "RATE_LIMITED", "too many reservations")
+	}
+
+	loc, err := parseReservationTimezone(c)
+	if err != nil {
+		return err
+	}
+
+	var cloneReq *CloneLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&cloneReq); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if err := validateReservationDuration(cloneReq.StartAt, cloneReq.EndAt); err != nil {
+		return err
+	}
+	if err := validateReservationTerm(cloneReq.StartAt, cloneReq.EndAt, loc); err != nil {
+		return err
+	}
+
+	var sourceModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &sourceModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if sourceModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't clone other streamer's livestream")
+	}
+
+	var tagIDs []int64
+	if err := dbConn.SelectContext(ctx, &tagIDs, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	// 複製元の内容で通常の予約と同じ処理を行う
+	req := &ReserveLivestreamRequest{
+		Tags:         tagIDs,
+		Title:        sourceModel.Title,
+		Description:  sourceModel.Description,
+		PlaylistUrl:  sourceModel.PlaylistUrl,
+		ThumbnailUrl: sourceModel.ThumbnailUrl,
+		StartAt:      cloneReq.StartAt,
+		EndAt:        cloneReq.EndAt,
+	}
+
+	var livestream Livestream
+	err = retryOnLockConflict(ctx, c.Logger(), func() error {
+		var err error
+		livestream, _, err = reserveLivestream(ctx, c.Logger(), userID, req, "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+const (
+	maxLivestreamTitleLength       = 255
+	maxLivestreamDescriptionLength = 2000
+)
+
+// validateLivestreamText はタイトルと説明文の長さをチェックする
+// 日本語のタイトルを弾かないよう、バイト数ではなく文字数で数える
+func validateLivestreamText(title, description string) error {
+	if utf8.RuneCountInString(title) > maxLivestreamTitleLength {
+		return newAPIError(http.StatusBadRequest, "TEXT_TOO_LONG", fmt.Sprintf("title must be at most %d characters", maxLivestreamTitleLength))
+	}
+	if utf8.RuneCountInString(description) > maxLivestreamDescriptionLength {
+		return newAPIError(http.StatusBadRequest, "TEXT_TOO_LONG", fmt.Sprintf("description must be at most %d characters", maxLivestreamDescriptionLength))
+	}
+	return nil
+}
+
+const (
+	minLivestreamDuration = 1 * time.Hour
+	maxLivestreamDuration = 24 * time.Hour
+)
+
+// validateReservationDuration は配信の長さが許容範囲内かチェックする
+func validateReservationDuration(startAt, endAt int64) error {
+	if endAt <= startAt {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", "end_at must be after start_at")
+	}
+	duration := time.Duration(endAt-startAt) * time.Second
+	if duration < minLivestreamDuration {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", fmt.Sprintf("livestream must be at least %s long", minLivestreamDuration))
+	}
+	if duration > maxLivestreamDuration {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", fmt.Sprintf("livestream must be at most %s long", maxLivestreamDuration))
+	}
+	return nil
+}
+
+// validateReservationTerm は予約区間が予約可能な期間内であるかチェックする
+// locはエラーメッセージで予約可能な期間を表示するタイムゾーンで、判定には影響しない
+func validateReservationTerm(startAt, endAt int64, loc *time.Location) error {
 	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
+		reserveStartAt = time.Unix(startAt, 0)
+		reserveEndAt   = time.Unix(endAt, 0)
 	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	if (reserveStartAt.Equal(reservationTermEndAt) || reserveStartAt.After(reservationTermEndAt)) || (reserveEndAt.Equal(reservationTermStartAt) || reserveEndAt.Before(reservationTermStartAt)) {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", fmt.Sprintf("bad reservation time range: must overlap %s ~ %s",
+			reservationTermStartAt.In(loc).Format(time.RFC3339), reservationTermEndAt.In(loc).Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// parseReservationTimezone は tz クエリパラメータ (例: Asia/Tokyo) を読む。省略時はUTC
+// start_at/end_atの解釈は変えず、エラーメッセージ中の日時の表示にだけ使う
+func parseReservationTimezone(c echo.Context) (*time.Location, error) {
+	tz := c.QueryParam("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "tz query parameter must be an IANA time zone name")
+	}
+	return loc, nil
+}
+
+// validateTagIDs は存在しないタグが指定されていないか検証し、別名のタグを正規のタグに置き換える
+// 返り値は指定順を保った重複のないタグID
+func validateTagIDs(ctx context.Context, tx *sqlx.Tx, requestedTagIDs []int64) ([]int64, error) {
+	if len(requestedTagIDs) == 0 {
+		return []int64{}, nil
+	}
+
+	existing, err := tagsCache.lookup(ctx, requestedTagIDs)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	var unknownTagIDs []string
+	for _, tagID := range requestedTagIDs {
+		if _, ok := existing[tagID]; !ok {
+			unknownTagIDs = append(unknownTagIDs, strconv.FormatInt(tagID, 10))
+		}
+	}
+	if len(unknownTagIDs) > 0 {
+		return nil, newAPIError(http.StatusBadRequest, "UNKNOWN_TAG", "unknown tag ids: "+strings.Join(unknownTagIDs, ","))
+	}
+
+	// 別名を置き換えた結果同じタグになることがあるので、置き換えた後で重複を除く
+	canonicalTagIDs, err := tagsCache.canonicalIDs(ctx, requestedTagIDs)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	tagIDs := make([]int64, 0, len(canonicalTagIDs))
+	seen := make(map[int64]struct{}, len(canonicalTagIDs))
+	for _, tagID := range canonicalTagIDs {
+		if _, ok := seen[tagID]; ok {
+			continue
+		}
+		seen[tagID] = struct{}{}
+		tagIDs = append(tagIDs, tagID)
 	}
 
+	return tagIDs, nil
+}
+
+// reserveSlots は予約区間に含まれる予約枠の残数をそれぞれ1つ減らす
+// すべての枠に残りがあることを確かめてから減らすので、一部の枠だけが減ることはない
+func reserveSlots(ctx context.Context, logger echo.Logger, tx *sqlx.Tx, startAt, endAt int64) error {
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要。ロックした時点の残数で判定できるので、枠ごとに引き直さない
 	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at FOR UPDATE", startAt, endAt); err != nil {
+		logger.Warnf("予約枠一覧取得でエラー発生: %+v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error()).SetInternal(err)
 	}
 	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+		if slot.Slot < 1 {
+			return newAPIErrorWithInternal(http.StatusBadRequest, "SLOT_FULL", fmt.Sprintf("予約枠 %d ~ %dに空きがないため、予約区間 %d ~ %dが予約できません", slot.StartAt, slot.EndAt, startAt, endAt), errReservationSlotFull)
 		}
 	}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
-		}
-	)
+	// 予約区間と重なる予約枠の数
+	// 区間が予約枠の境界に揃っていないと、一部の枠が減算されないまま予約が成立してしまうので検出に使う
+	var expectedSlots int64
+	if err := tx.GetContext(ctx, &expectedSlots, "SELECT COUNT(*) FROM reservation_slots WHERE start_at < ? AND end_at > ?", endAt, startAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reservation_slots: "+err.Error()).SetInternal(err)
+	}
+	if len(slots) == 0 || int64(len(slots)) < expectedSlots {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", fmt.Sprintf("予約区間 %d ~ %dが予約枠の境界と一致しません", startAt, endAt))
+	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	// ここまでで全ての枠が予約できることを確認済み
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error()).SetInternal(err)
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	return nil
+}
+
+// insertLivestream は配信とタグを追加し、livestreamModel.IDを埋める
+func insertLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, tagIDs []int64) error {
+	if err := setLivestreamOwner(ctx, tx, livestreamModel, livestreamModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream owner: "+err.Error()).SetInternal(err)
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, created_at, owner_name, owner_display_name, owner_icon_hash) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :created_at, :owner_name, :owner_display_name, :owner_icon_hash)", livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error()).SetInternal(err)
 	}
 
 	livestreamID, err := rs.LastInsertId()
@@ -151,138 +586,634 @@ func reserveLivestreamHandler(c echo.Context) error {
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	for _, tagID := range req.Tags {
-		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+	// 予約枠のロックを保持している時間を短くするため、1回のINSERTでまとめて追加する
+	livestreamTagModels := make([]*LivestreamTagModel, len(tagIDs))
+	for i, tagID := range tagIDs {
+		livestreamTagModels[i] = &LivestreamTagModel{
 			LivestreamID: livestreamID,
 			TagID:        tagID,
-		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
 		}
 	}
+	if err := insertLivestreamTags(ctx, tx, livestreamTagModels); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tags: "+err.Error()).SetInternal(err)
+	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	return nil
+}
+
+// setLivestreamOwner は配信者をuserIDのユーザにし、複製して持つ配信者情報も合わせる
+// DBへの書き込みは行わない
+func setLivestreamOwner(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, userID int64) error {
+	var owner struct {
+		Name        string `db:"name"`
+		DisplayName string `db:"display_name"`
+		IconHash    string `db:"icon_hash"`
+	}
+	query := `
+	SELECT users.name, users.display_name, COALESCE(icons.hash, ?) AS icon_hash
+	FROM users
+	LEFT JOIN icons ON icons.user_id = users.id
+	WHERE users.id = ?
+	LIMIT 1
+	`
+	if err := tx.GetContext(ctx, &owner, query, fallbackImageHash, userID); err != nil {
+		return err
+	}
+
+	livestreamModel.UserID = userID
+	livestreamModel.OwnerName = owner.Name
+	livestreamModel.OwnerDisplayName = owner.DisplayName
+	livestreamModel.OwnerIconHash = owner.IconHash
+	return nil
+}
+
+// backfillLivestreamOwners は全配信の複製した配信者情報を作り直す
+// 初期データには入っていないので、初期化時に呼ぶ
+func backfillLivestreamOwners(ctx context.Context) error {
+	query := `
+	UPDATE livestreams
+	INNER JOIN users ON users.id = livestreams.user_id
+	LEFT JOIN icons ON icons.user_id = users.id
+	SET
+		livestreams.owner_name = users.name,
+		livestreams.owner_display_name = users.display_name,
+		livestreams.owner_icon_hash = COALESCE(icons.hash, ?)
+	`
+	_, err := dbConn.ExecContext(ctx, query, fallbackImageHash)
+	return err
+}
+
+const insertLivestreamTagsQuery = "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)"
+
+// buildInsertLivestreamTagsQuery は配信のタグをまとめて追加するINSERTを組み立てる
+// スライスを渡すとsqlxがVALUESを行数分に展開するので、1回のINSERTでまとめて追加される
+// 追加するタグがなければokはfalseになる
+func buildInsertLivestreamTagsQuery(livestreamTagModels []*LivestreamTagModel) (query string, args []interface{}, ok bool, err error) {
+	if len(livestreamTagModels) == 0 {
+		return "", nil, false, nil
+	}
+	query, args, err = sqlx.Named(insertLivestreamTagsQuery, livestreamTagModels)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		return "", nil, false, err
 	}
+	return query, args, true, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+// insertLivestreamTags は配信にタグを追加する。タグを追加する処理 (予約・複製・更新) はすべてここを通す
+// すでに付いているタグはlivestream_tagsのユニーク制約で弾かれるが、エラーにはせず追加済みとして扱う
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamTagModels []*LivestreamTagModel) error {
+	query, args, ok, err := buildInsertLivestreamTagsQuery(livestreamTagModels)
+	if !ok || err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err == nil || !isDuplicateEntryError(err) {
+		return err
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	// まとめてのINSERTは1行でも重複があると全体が失敗するので、1行ずつ入れ直す
+	for _, livestreamTagModel := range livestreamTagModels {
+		if _, err := tx.NamedExecContext(ctx, insertLivestreamTagsQuery, livestreamTagModel); err != nil && !isDuplicateEntryError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 配信検索の並び順
+// ORDER BY句を動的に組み立てるので、ここに定義された値以外は受け付けない
+var livestreamSearchOrders = map[string]string{
+	"newest":     "livestreams.id DESC",
+	"oldest":     "livestreams.id ASC",
+	"start_asc":  "livestreams.start_at ASC, livestreams.id ASC",
+	"start_desc": "livestreams.start_at DESC, livestreams.id DESC",
+}
+
+// タイトル検索クエリの最大文字数
+const maxSearchQueryLength = 255
+
+// likePatternEscaper はLIKEのワイルドカードをエスケープする (MySQLのデフォルトのエスケープ文字は\)
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLikePattern はユーザ入力をLIKEのパターン中でリテラルとして扱えるようにする
+func escapeLikePattern(s string) string {
+	return likePatternEscaper.Replace(s)
 }
 
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	keyTagName := c.QueryParam("tag")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	sortKey := c.QueryParam("sort")
+	if sortKey == "" {
+		sortKey = "newest"
+	}
+	orderBy, ok := livestreamSearchOrders[sortKey]
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "sort query parameter must be one of newest, oldest, start_asc, start_desc")
 	}
-	defer tx.Rollback()
 
-	var livestreamModels []LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		query := `
-		SELECT
-			livestreams.id AS id,
-			livestreams.user_id AS user_id,
-			livestreams.title AS title,
-			livestreams.description AS description,
-			livestreams.playlist_url AS playlist_url,
-			livestreams.thumbnail_url AS thumbnail_url,
-			livestreams.start_at AS start_at,
-			livestreams.end_at AS end_at
-		FROM
-			livestreams
-			JOIN livestream_tags ON livestreams.id = livestream_tags.livestream_id
-			JOIN tags ON livestream_tags.tag_id = tags.id
-		WHERE
-			tags.name = ?
-		ORDER BY
-			livestreams.id DESC
-		`
-
-		if err := tx.SelectContext(ctx, &livestreamModels, query, keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	// 時間帯による絞り込み
+	// live_at: その時刻に配信中のもの, from/to: その期間に重なるもの
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	for _, filter := range []struct {
+		param     string
+		condition string
+		argCount  int
+	}{
+		{param: "live_at", condition: "livestreams.start_at <= ? AND livestreams.end_at > ?", argCount: 2},
+		{param: "from", condition: "livestreams.end_at > ?", argCount: 1},
+		{param: "to", condition: "livestreams.start_at < ?", argCount: 1},
+	} {
+		if c.QueryParam(filter.param) == "" {
+			continue
 		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+		v, err := strconv.ParseInt(c.QueryParam(filter.param), 10, 64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", filter.param+" query parameter must be integer")
 		}
+		conditions = append(conditions, filter.condition)
+		for i := 0; i < filter.argCount; i++ {
+			args = append(args, v)
+		}
+	}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	// タイトルの部分一致 (大文字小文字を区別しない)
+	if q := c.QueryParam("q"); q != "" {
+		if utf8.RuneCountInString(q) > maxSearchQueryLength {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", fmt.Sprintf("q query parameter must be at most %d characters", maxSearchQueryLength))
 		}
+		conditions = append(conditions, "LOWER(livestreams.title) LIKE ?")
+		args = append(args, "%"+escapeLikePattern(strings.ToLower(q))+"%")
 	}
 
-	// User の取得
-	userMap := map[int64]User{}
-	{
-		userIDMap := map[int64]struct{}{}
-		for _, livestreamModel := range livestreamModels {
-			userIDMap[livestreamModel.UserID] = struct{}{}
+	// アーカイブ済みの配信は明示しない限り含めない
+	if c.QueryParam("include_archived") != "1" {
+		conditions = append(conditions, "livestreams.is_archived = FALSE")
+	}
+
+	// after_id はID順の並びでのみ、envelope=1 で返したnext_cursorの続きを取得するのに使える
+	if v := c.QueryParam("after_id"); v != "" {
+		afterID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "after_id query parameter must be integer")
 		}
+		switch sortKey {
+		case "newest":
+			conditions = append(conditions, "livestreams.id < ?")
+		case "oldest":
+			conditions = append(conditions, "livestreams.id > ?")
+		default:
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "after_id query parameter can only be used with sort newest or oldest")
+		}
+		args = append(args, afterID)
+	}
 
-		if len(userIDMap) > 0 {
-			userIDs := make([]int64, 0)
-			for userID := range userIDMap {
-				userIDs = append(userIDs, userID)
-			}
+	limit, err := parseListLimit(c)
+	if err != nil {
+		return err
+	}
 
-			var userModels []struct {
-				UserID      int64  `db:"user_id"`
-				Name        string `db:"name"`
-				DisplayName string `db:"display_name"`
-				Description string `db:"description"`
-				Password    string `db:"password"`
-				ThemeID     int64  `db:"theme_id"`
-				DarkMode    bool   `db:"dark_mode"`
-				Image       []byte `db:"image"`
-			}
-			// TODO: themes も LEFT JOIN のほうがいいかも？
-			query, params, err := sqlx.In(`
-				SELECT
-					users.id AS user_id,
-					users.name,
-					users.display_name,
-					users.description,
-					themes.id AS theme_id,
-					dark_mode,
-					image
-				FROM
-					users
-					JOIN themes ON users.id = themes.user_id
-					LEFT JOIN icons ON users.id = icons.user_id
-				WHERE
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 同じ検索の繰り返しは、配信が増えていなければ結果を組み立てずに304を返す
+	etag, notModified, err := checkSearchETag(c, tx)
+	if notModified || err != nil {
+		return err
+	}
+	// 結果の取得はsearchCacheが専用のトランザクションで行う
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// light=1の場合は配信に複製した配信者情報だけを返し、users/themes/icons を引かない
+	light := c.QueryParam("light") == "1"
+
+	result, err := searchCache.do(ctx, etag+" "+c.QueryParams().Encode(), func(ctx context.Context, tx *sqlx.Tx) (searchResult, error) {
+		var livestreamModels []LivestreamModel
+		if c.QueryParam("tag") != "" {
+			// タグによる取得
+			query := `
+			SELECT
+				livestreams.id AS id,
+				livestreams.user_id AS user_id,
+				livestreams.title AS title,
+				livestreams.description AS description,
+				livestreams.playlist_url AS playlist_url,
+				livestreams.thumbnail_url AS thumbnail_url,
+				livestreams.start_at AS start_at,
+				livestreams.end_at AS end_at,
+				livestreams.created_at AS created_at,
+				livestreams.is_archived AS is_archived,
+				livestreams.owner_name AS owner_name,
+				livestreams.owner_display_name AS owner_display_name,
+				livestreams.owner_icon_hash AS owner_icon_hash,
+				livestreams.version AS version,
+				livestreams.current_viewers AS current_viewers,
+				livestreams.reactions_count AS reactions_count,
+				livestreams.peak_viewers AS peak_viewers
+			FROM
+				livestreams
+				JOIN livestream_tags ON livestreams.id = livestream_tags.livestream_id
+			WHERE
+				` + strings.Join(append([]string{"livestream_tags.tag_id = ?"}, conditions...), " AND ") + `
+			ORDER BY
+				` + orderBy + fmt.Sprintf(" LIMIT %d", limit)
+
+			// 存在しないタグ名なら該当する配信はない
+			tagID, ok, err := tagsCache.idByTagName(ctx, keyTagName)
+			if err != nil {
+				return searchResult{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+			}
+			if ok {
+				if err := tx.SelectContext(ctx, &livestreamModels, query, append([]interface{}{tagID}, args...)...); err != nil {
+					return searchResult{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+				}
+			}
+		} else {
+			// タグ指定なし
+			query := `SELECT * FROM livestreams`
+			if len(conditions) > 0 {
+				query += ` WHERE ` + strings.Join(conditions, " AND ")
+			}
+			query += ` ORDER BY ` + orderBy + fmt.Sprintf(" LIMIT %d", limit)
+
+			if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+				return searchResult{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+			}
+		}
+
+		if light {
+			livestreams, err := fillLightLivestreamResponses(ctx, tx, livestreamModels)
+			if err != nil {
+				return searchResult{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+			}
+			return searchResult{lightLivestreams: livestreams}, nil
+		}
+
+		livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+		if err != nil {
+			return searchResult{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+		return searchResult{livestreams: livestreams}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.QueryParam("envelope") == "1" {
+		var (
+			items interface{}
+			ids   []int64
+		)
+		if light {
+			items = result.lightLivestreams
+			for _, livestream := range result.lightLivestreams {
+				ids = append(ids, livestream.ID)
+			}
+		} else {
+			items = result.livestreams
+			for _, livestream := range result.livestreams {
+				ids = append(ids, livestream.ID)
+			}
+		}
+		if len(ids) == 0 {
+			items = []Livestream{}
+		}
+		res := newListEnvelope(items, ids, limit)
+		// after_idで続きを取得できるのはID順の並びだけなので、それ以外ではnext_cursorを返さない
+		if sortKey != "newest" && sortKey != "oldest" {
+			res.NextCursor = nil
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+
+	// 結果はキャッシュと共有するため組み立て済みなので、まとめてエンコードする
+	// 件数はparseListLimitの上限で抑えている
+	if light {
+		if result.lightLivestreams == nil {
+			return c.JSON(http.StatusOK, []LightLivestream{})
+		}
+		return c.JSON(http.StatusOK, result.lightLivestreams)
+	}
+	if result.livestreams == nil {
+		return c.JSON(http.StatusOK, []Livestream{})
+	}
+	return c.JSON(http.StatusOK, result.livestreams)
+}
+
+const (
+	defaultLivestreamFeedLimit = 20
+	maxLivestreamFeedLimit     = 100
+)
+
+// ListEnvelope はenvelope=1 の場合に一覧をページング情報と合わせて返す形
+type ListEnvelope struct {
+	Items interface{} `json:"items"`
+	// 次のページを取得する際にafter_idへ渡す値。続きがなければnull
+	NextCursor *int64 `json:"next_cursor"`
+	// Total は条件に合う全件数。数えるのが高くつく場合は省く
+	Total *int `json:"total,omitempty"`
+}
+
+// newListEnvelope はlimit件で打ち切った一覧のenvelopeを作る。idsはitemsの各要素のID
+// ページが埋まっていれば続きがあるものとみなし、最後の要素のIDをnext_cursorにする
+// 打ち切った場合は全件数の数え直しが必要になるのでtotalは省く
+func newListEnvelope(items interface{}, ids []int64, limit int) ListEnvelope {
+	res := ListEnvelope{Items: items}
+	if len(ids) > 0 && len(ids) == limit {
+		res.NextCursor = &ids[len(ids)-1]
+		return res
+	}
+	total := len(ids)
+	res.Total = &total
+	return res
+}
+
+// parseListLimit は一覧APIのlimitを読む
+// 省略時はdefaultListLimit、maxListLimitを超える場合はエラーにせずmaxListLimitに切り詰める
+func parseListLimit(c echo.Context) (int, error) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return defaultListLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return 0, newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be non-negative integer")
+	}
+	if limit > maxListLimit {
+		c.Logger().Debugf("clamped limit %d to %d", limit, maxListLimit)
+		limit = maxListLimit
+	}
+	return limit, nil
+}
+
+type LivestreamFeedResponse struct {
+	Livestreams []Livestream `json:"livestreams"`
+	// 次のページを取得する際にafter_idへ渡す値。続きがなければnull
+	NextCursor *int64 `json:"next_cursor"`
+}
+
+// 配信フィードAPI
+// GET /api/livestream/feed
+// 全ユーザの配信を新しい順に返す。after_idを指定すると、そのIDより前 (古い側) の続きを返す
+// OFFSETを使わないので、深いページでも同じコストで取得できる
+func getLivestreamFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit, afterID, err := parseLivestreamFeedPage(c)
+	if err != nil {
+		return err
+	}
+
+	conditions := []string{"is_archived = FALSE"}
+	var args []interface{}
+	if afterID != nil {
+		conditions = append(conditions, "id < ?")
+		args = append(args, *afterID)
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []LivestreamModel
+	query := "SELECT * FROM livestreams WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id DESC LIMIT ?"
+	if err := tx.SelectContext(ctx, &livestreamModels, query, append(args, limit)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newLivestreamFeedResponse(livestreamModels, livestreams, limit))
+}
+
+// parseLivestreamFeedPage はフィードのlimitとafter_idを読む。after_idがなければnil
+func parseLivestreamFeedPage(c echo.Context) (int, *int64, error) {
+	limit := defaultLivestreamFeedLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			return 0, nil, newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be positive integer")
+		}
+		if l > maxLivestreamFeedLimit {
+			l = maxLivestreamFeedLimit
+		}
+		limit = l
+	}
+
+	afterID, err := parseAfterID(c)
+	if err != nil {
+		return 0, nil, err
+	}
+	return limit, afterID, nil
+}
+
+// parseAfterID はページングのafter_idを読む。指定がなければnil
+func parseAfterID(c echo.Context) (*int64, error) {
+	v := c.QueryParam("after_id")
+	if v == "" {
+		return nil, nil
+	}
+	afterID, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "after_id query parameter must be integer")
+	}
+	return &afterID, nil
+}
+
+// newLivestreamFeedResponse はID降順に並んだ配信から、次のページのカーソル付きのレスポンスを作る
+func newLivestreamFeedResponse(livestreamModels []LivestreamModel, livestreams []Livestream, limit int) LivestreamFeedResponse {
+	res := LivestreamFeedResponse{
+		Livestreams: livestreams,
+	}
+	// ページが埋まっていれば続きがあるものとみなす
+	if len(livestreamModels) == limit {
+		nextCursor := livestreamModels[len(livestreamModels)-1].ID
+		res.NextCursor = &nextCursor
+	}
+	return res
+}
+
+const (
+	defaultRelatedLivestreamsLimit = 10
+	maxRelatedLivestreamsLimit     = 50
+)
+
+// 関連配信API
+// GET /api/livestream/:livestream_id/related
+// 指定した配信と共通するタグが多い順、同数なら新しい順に配信を返す
+func getRelatedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	limit := defaultRelatedLivestreamsLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be positive integer")
+		}
+		if l > maxRelatedLivestreamsLimit {
+			l = maxRelatedLivestreamsLimit
+		}
+		limit = l
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.GetContext(ctx, &exists, "SELECT 1 FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	// タグのない配信なら、共通するタグを持つ配信もないので空になる
+	var related []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		SharedTags   int64 `db:"shared_tags"`
+	}
+	query := `
+	SELECT lt.livestream_id, COUNT(*) AS shared_tags
+	FROM livestream_tags lt
+	INNER JOIN livestreams l ON l.id = lt.livestream_id
+	WHERE
+		lt.tag_id IN (SELECT tag_id FROM livestream_tags WHERE livestream_id = ?)
+		AND lt.livestream_id <> ?
+		AND l.is_archived = FALSE
+	GROUP BY lt.livestream_id
+	ORDER BY shared_tags DESC, lt.livestream_id DESC
+	LIMIT ?
+	`
+	if err := tx.SelectContext(ctx, &related, query, livestreamID, livestreamID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get related livestreams: "+err.Error())
+	}
+
+	livestreamModels := make([]LivestreamModel, 0, len(related))
+	if len(related) > 0 {
+		relatedIDs := make([]int64, len(related))
+		for i := range related {
+			relatedIDs[i] = related[i].LivestreamID
+		}
+		var models []LivestreamModel
+		query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", relatedIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &models, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		modelMap := make(map[int64]LivestreamModel, len(models))
+		for _, model := range models {
+			modelMap[model.ID] = model
+		}
+		// 共通タグ数の順を保つ
+		for _, r := range related {
+			if model, ok := modelMap[r.LivestreamID]; ok {
+				livestreamModels = append(livestreamModels, model)
+			}
+		}
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// fillLivestreamResponses は複数の配信のレスポンスをまとめて組み立てる
+// 配信者・タグ・視聴者数はそれぞれ1回のクエリでまとめて取得する
+func fillLivestreamResponses(ctx context.Context, tx *sqlx.Tx, livestreamModels []LivestreamModel) ([]Livestream, error) {
+	// User の取得
+	userMap := map[int64]User{}
+	{
+		userIDMap := map[int64]struct{}{}
+		for _, livestreamModel := range livestreamModels {
+			userIDMap[livestreamModel.UserID] = struct{}{}
+		}
+
+		if len(userIDMap) > 0 {
+			userIDs := make([]int64, 0)
+			for userID := range userIDMap {
+				userIDs = append(userIDs, userID)
+			}
+
+			var userModels []struct {
+				UserID      int64          `db:"user_id"`
+				Name        string         `db:"name"`
+				DisplayName string         `db:"display_name"`
+				Description string         `db:"description"`
+				Password    string         `db:"password"`
+				ThemeID     int64          `db:"theme_id"`
+				DarkMode    bool           `db:"dark_mode"`
+				IconHash    sql.NullString `db:"icon_hash"`
+			}
+			// themesの行がないユーザも落とさないようLEFT JOINにし、その場合はThemeをゼロ値(ID 0, ライトモード)にする
+			query, params, err := sqlx.In(`
+				SELECT
+					users.id AS user_id,
+					users.name,
+					users.display_name,
+					users.description,
+					COALESCE(themes.id, 0) AS theme_id,
+					COALESCE(themes.dark_mode, FALSE) AS dark_mode,
+					icons.hash AS icon_hash
+				FROM
+					users
+					LEFT JOIN themes ON users.id = themes.user_id
+					LEFT JOIN icons ON users.id = icons.user_id
+				WHERE
 					users.id IN (?)
 				`,
 				userIDs)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to create users query: "+err.Error())
+				return nil, err
 			}
 			if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+				return nil, err
 			}
 			for _, userModel := range userModels {
-				var image []byte
-				if userModel.Image == nil {
-					image, err = os.ReadFile(fallbackImage)
-					if err != nil {
-						return echo.NewHTTPError(http.StatusInternalServerError, "failed read fallback image: "+err.Error())
-					}
-				} else {
-					image = userModel.Image
+				// アイコンのハッシュは登録時に計算済みのものを使う
+				// アイコン未登録なら代わりの画像のハッシュで、画像は読まないので読めなくても失敗しない
+				iconHash := userModel.IconHash.String
+				if !userModel.IconHash.Valid {
+					iconHash = fallbackImageHash
 				}
-				iconHash := fmt.Sprintf("%x", sha256.Sum256(image))
 
 				userMap[userModel.UserID] = User{
 					ID:          userModel.UserID,
@@ -300,166 +1231,1128 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 
 	// Tags の取得
-	tagsMap := map[int64][]Tag{}
-	{
-		if len(livestreamModels) > 0 {
-			livestreamIDs := make([]int64, len(livestreamModels))
-			for i, livestreamModel := range livestreamModels {
-				livestreamIDs[i] = livestreamModel.ID
-			}
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamIDs[i] = livestreamModel.ID
+	}
+	tagsMap, err := getLivestreamTagsMap(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
 
-			var tagModels []struct {
-				LivestreamID int64  `db:"livestream_id"`
-				ID           int64  `db:"id"`
-				Name         string `db:"name"`
-			}
-			query, params, err := sqlx.In(`
-				SELECT
-					livestream_tags.livestream_id,
-					tags.id,
-					tags.name
-				FROM
-					tags
-					JOIN livestream_tags ON tags.id = livestream_tags.tag_id
-				WHERE
-					livestream_tags.livestream_id IN (?)
-				ORDER BY
-					livestream_tags.id
-				`,
-				livestreamIDs)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to create tags query: "+err.Error())
-			}
-			if err := tx.SelectContext(ctx, &tagModels, query, params...); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-			}
-			for _, tagModel := range tagModels {
-				tags, ok := tagsMap[tagModel.LivestreamID]
-				if !ok {
-					tags = make([]Tag, 0)
-				}
-				tags = append(tags, Tag{
-					ID:   tagModel.ID,
-					Name: tagModel.Name,
-				})
-				tagsMap[tagModel.LivestreamID] = tags
-			}
+	commentsCountMap, err := getLivestreamCommentsCounts(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	now := requestTime(ctx)
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		state := livestreamState(livestreamModel.StartAt, livestreamModel.EndAt, now)
+		livestreams[i] = Livestream{
+			ID:             livestreamModel.ID,
+			Owner:          userMap[livestreamModel.UserID],
+			Title:          livestreamModel.Title,
+			Tags:           tagsMap[livestreamModel.ID],
+			Description:    livestreamModel.Description,
+			PlaylistUrl:    livestreamModel.PlaylistUrl,
+			ThumbnailUrl:   livestreamModel.ThumbnailUrl,
+			StartAt:        livestreamModel.StartAt,
+			EndAt:          livestreamModel.EndAt,
+			CreatedAt:      livestreamModel.CreatedAt,
+			IsArchived:     livestreamModel.IsArchived,
+			ViewersCount:   livestreamModel.CurrentViewers,
+			ReactionsCount: livestreamModel.ReactionsCount,
+			State:          state,
+			IsLive:         state == livestreamStateLive,
+			CommentsCount:  commentsCountMap[livestreamModel.ID],
+			Version:        livestreamModel.Version,
+		}
+	}
+	return livestreams, nil
+}
+
+// fillLightLivestreamResponses は配信に複製した配信者情報を使ってレスポンスを組み立てる
+func fillLightLivestreamResponses(ctx context.Context, tx *sqlx.Tx, livestreamModels []LivestreamModel) ([]LightLivestream, error) {
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamIDs[i] = livestreamModel.ID
+	}
+	tagsMap, err := getLivestreamTagsMap(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	commentsCountMap, err := getLivestreamCommentsCounts(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	now := requestTime(ctx)
+	livestreams := make([]LightLivestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		state := livestreamState(livestreamModel.StartAt, livestreamModel.EndAt, now)
+		livestreams[i] = LightLivestream{
+			Livestream: Livestream{
+				ID:             livestreamModel.ID,
+				Title:          livestreamModel.Title,
+				Tags:           tagsMap[livestreamModel.ID],
+				Description:    livestreamModel.Description,
+				PlaylistUrl:    livestreamModel.PlaylistUrl,
+				ThumbnailUrl:   livestreamModel.ThumbnailUrl,
+				StartAt:        livestreamModel.StartAt,
+				EndAt:          livestreamModel.EndAt,
+				CreatedAt:      livestreamModel.CreatedAt,
+				IsArchived:     livestreamModel.IsArchived,
+				ViewersCount:   livestreamModel.CurrentViewers,
+				ReactionsCount: livestreamModel.ReactionsCount,
+				State:          state,
+				IsLive:         state == livestreamStateLive,
+				CommentsCount:  commentsCountMap[livestreamModel.ID],
+				Version:        livestreamModel.Version,
+			},
+			Owner: LivestreamOwnerSummary{
+				ID:          livestreamModel.UserID,
+				Name:        livestreamModel.OwnerName,
+				DisplayName: livestreamModel.OwnerDisplayName,
+				IconHash:    livestreamModel.OwnerIconHash,
+			},
 		}
 	}
+	return livestreams, nil
+}
+
+func getMyLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	limit, err := parseListLimit(c)
+	if err != nil {
+		return err
+	}
+	afterID, err := parseAfterID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamModels, livestreams, err := getUserLivestreamsPage(ctx, tx, userID, afterID, limit)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return userLivestreamsResponse(c, livestreamModels, livestreams, limit)
+}
+
+func getUserLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	username := c.Param("username")
+
+	limit, err := parseListLimit(c)
+	if err != nil {
+		return err
+	}
+	afterID, err := parseAfterID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	user, err := getUserByName(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	// 配信が追加されていなければ304を返し、一覧の組み立てを省く
+	notModified, err := checkUserLivestreamsModified(c, tx, user.ID)
+	if notModified || err != nil {
+		return err
+	}
+
+	livestreamModels, livestreams, err := getUserLivestreamsPage(ctx, tx, user.ID, afterID, limit)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return userLivestreamsResponse(c, livestreamModels, livestreams, limit)
+}
+
+// checkUserLivestreamsModified はユーザが最後に配信を追加した時刻をLast-Modifiedに設定し、
+// If-Modified-Sinceがそれ以降なら304を書き込んでnotModifiedにtrueを返す
+// 追加時刻のない古い配信はstart_atを追加時刻とみなす。ただしstart_atは未来のこともあるので、
+// 予約受付の開始時刻で頭打ちにして、リクエストごとに変わらない値にする
+// 配信の編集・削除では変わらないので、304を受け取るクライアントには次に配信が追加されるまで反映されない
+func checkUserLivestreamsModified(c echo.Context, tx *sqlx.Tx, userID int64) (bool, error) {
+	ctx := c.Request().Context()
+
+	var lastModifiedUnix int64
+	if err := tx.GetContext(ctx, &lastModifiedUnix, "SELECT COALESCE(MAX(IF(created_at > 0, created_at, LEAST(start_at, ?))), 0) FROM livestreams WHERE user_id = ?", reservationTermStartAt.Unix(), userID); err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last modified time: "+err.Error())
+	}
+	if lastModifiedUnix == 0 {
+		return false, nil
+	}
+	lastModified := time.Unix(lastModifiedUnix, 0).UTC()
+	c.Response().Header().Set(echo.HeaderLastModified, lastModified.Format(http.TimeFormat))
+	if ims, err := http.ParseTime(c.Request().Header.Get(echo.HeaderIfModifiedSince)); err == nil && !lastModified.After(ims) {
+		return true, c.NoContent(http.StatusNotModified)
+	}
+	return false, nil
+}
+
+// getUserLivestreamsPage はユーザの配信をIDの昇順にlimit件取得する。afterIDがあればそのIDより後の続きを返す
+func getUserLivestreamsPage(ctx context.Context, tx *sqlx.Tx, userID int64, afterID *int64, limit int) ([]*LivestreamModel, []Livestream, error) {
+	query := "SELECT * FROM livestreams WHERE user_id = ?"
+	args := []interface{}{userID}
+	if afterID != nil {
+		query += " AND id > ?"
+		args = append(args, *afterID)
+	}
+	query += " ORDER BY id LIMIT ?"
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, append(args, limit)...); err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+	return livestreamModels, livestreams, nil
+}
+
+// userLivestreamsResponse はenvelope=1 ならnext_cursor付きで、そうでなければ配列のまま返す
+// 配列の場合はlimitで打ち切られたかわからないので、続きを取得するクライアントはenvelope=1 を使う
+func userLivestreamsResponse(c echo.Context, livestreamModels []*LivestreamModel, livestreams []Livestream, limit int) error {
+	if c.QueryParam("envelope") == "1" {
+		ids := make([]int64, len(livestreamModels))
+		for i := range livestreamModels {
+			ids[i] = livestreamModels[i].ID
+		}
+		return c.JSON(http.StatusOK, newListEnvelope(livestreams, ids, limit))
+	}
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// getUserByName はユーザ名からユーザを引く。存在しなければ404を返す
+func getUserByName(ctx context.Context, tx *sqlx.Tx, username string) (UserModel, error) {
+	var user UserModel
+	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserModel{}, newAPIError(http.StatusNotFound, "USER_NOT_FOUND", "user not found")
+		}
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	return user, nil
+}
+
+// viewerテーブルの廃止
+// セッションと配信の存在はsessionMiddleware, livestreamMiddlewareで確認済み
+func enterLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID := livestreamFromContext(c).ID
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	viewer := LivestreamViewerModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	// 再入室で視聴履歴が重複しないよう、既に視聴中であれば何もしない
+	// 同時に入室しても(user_id, livestream_id)の一意キーで1行に絞られ、挿入できた側だけが視聴者数を増やす
+	rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+	}
+	entered, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get inserted livestream_view_history count: "+err.Error())
+	}
+	if entered == 1 {
+		if err := adjustCurrentViewers(ctx, tx, viewer.LivestreamID, 0, 1); err != nil {
+			return err
+		}
+		if err := recordViewerEvent(ctx, tx, viewer.LivestreamID, viewer.UserID, 1, viewer.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if err := recordWatchHistory(ctx, tx, viewer); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// セッションと配信の存在はsessionMiddleware, livestreamMiddlewareで確認済み
+func exitLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID := livestreamFromContext(c).ID
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	}
+	exited, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted livestream_view_history count: "+err.Error())
+	}
+	if err := adjustCurrentViewers(ctx, tx, livestreamID, exited, 0); err != nil {
+		return err
+	}
+	if err := recordViewerEvent(ctx, tx, livestreamID, userID, -exited, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+type ResumeLivestreamResponse struct {
+	CreatedAt int64 `json:"created_at"`
+}
+
+// 視聴再開API
+// POST /api/livestream/:livestream_id/resume
+// 再接続したクライアント向けに、以前の視聴履歴を消して入室し直す (exit + enter)
+// 異常終了したセッションの履歴が残って視聴者数がずれるのを防ぐ
+func resumeLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.GetContext(ctx, &exists, "SELECT 1 FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	}
+	exited, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted livestream_view_history count: "+err.Error())
+	}
+
+	viewer := LivestreamViewerModel{
+		UserID:       userID,
+		LivestreamID: int64(livestreamID),
+		CreatedAt:    time.Now().Unix(),
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+	}
+	if err := adjustCurrentViewers(ctx, tx, viewer.LivestreamID, exited, 1); err != nil {
+		return err
+	}
+	// 退室してから入室し直したものとして記録する
+	if err := recordViewerEvent(ctx, tx, viewer.LivestreamID, userID, -exited, viewer.CreatedAt); err != nil {
+		return err
+	}
+	if err := recordViewerEvent(ctx, tx, viewer.LivestreamID, userID, 1, viewer.CreatedAt); err != nil {
+		return err
+	}
+	if err := recordWatchHistory(ctx, tx, viewer); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ResumeLivestreamResponse{
+		CreatedAt: viewer.CreatedAt,
+	})
+}
+
+// サムネイルのサイズ指定として受け付ける値
+var thumbnailSizes = map[string]struct{}{
+	"small":  {},
+	"medium": {},
+	"large":  {},
+}
+
+// sizedThumbnailURL はサムネイルURLのファイル名の拡張子の前にサイズを付与する
+// e.g. https://media.xiii.isucon.dev/yoru.webp -> https://media.xiii.isucon.dev/yoru_small.webp
+// サムネイル未設定の場合はデフォルトのサムネイルを使う
+func sizedThumbnailURL(thumbnailURL, size string) string {
+	if thumbnailURL == "" {
+		thumbnailURL = defaultThumbnailURL
+	}
+	u, err := url.Parse(thumbnailURL)
+	if err != nil {
+		return thumbnailURL
+	}
+	ext := path.Ext(u.Path)
+	u.Path = strings.TrimSuffix(u.Path, ext) + "_" + size + ext
+	return u.String()
+}
+
+// セッションと配信の存在はsessionMiddleware, livestreamMiddlewareで確認済み
+func getLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	thumbSize := c.QueryParam("thumb")
+	if _, ok := thumbnailSizes[thumbSize]; thumbSize != "" && !ok {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "thumb query parameter must be one of small, medium, large")
+	}
+
+	// expand で配信者とタグのどちらを含めるか選べる。指定がなければ両方含める
+	expandOwner, expandTags := true, true
+	if c.QueryParams().Has("expand") {
+		expandOwner, expandTags = false, false
+		for _, field := range strings.Split(c.QueryParam("expand"), ",") {
+			switch field {
+			case "":
+				// expand= は何も展開しない
+			case "owner":
+				expandOwner = true
+			case "tags":
+				expandTags = true
+			default:
+				return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "expand query parameter must be a comma separated list of owner, tags")
+			}
+		}
+	}
+
+	// fields=no_owner の場合は配信者の取得を省く
+	if fields := c.QueryParam("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			switch field {
+			case "no_owner":
+				expandOwner = false
+			default:
+				return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "fields query parameter must be no_owner")
+			}
+		}
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel := livestreamFromContext(c)
+
+	// 省く部分は取得しない
+	if !expandOwner || !expandTags {
+		livestream, err := fillLivestreamScalars(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		res := PartialLivestream{Livestream: livestream}
+		if expandOwner {
+			owner, err := fillLivestreamOwner(ctx, tx, livestreamModel)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream owner: "+err.Error())
+			}
+			if err := embedOwnerIcon(c, &owner); err != nil {
+				return err
+			}
+			res.Owner = &owner
+		}
+		if expandTags {
+			tags, err := fillLivestreamTags(ctx, tx, livestreamModel)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream tags: "+err.Error())
+			}
+			res.Tags = &tags
+		}
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		if thumbSize != "" {
+			res.ThumbnailUrl = sizedThumbnailURL(res.ThumbnailUrl, thumbSize)
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 人気の配信には同時にアクセスが集中するので、同じ配信のfillはまとめる
+	livestream, err := fillLivestreamResponseShared(ctx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if thumbSize != "" {
+		livestream.ThumbnailUrl = sizedThumbnailURL(livestream.ThumbnailUrl, thumbSize)
+	}
+
+	if err := embedOwnerIcon(c, &livestream.Owner); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// embedOwnerIcon はinclude_icon=1 の場合に配信者アイコンをbase64で埋め込む
+// 往復は1回減るが、レスポンスサイズはおおよそ倍になる
+func embedOwnerIcon(c echo.Context, owner *User) error {
+	if c.QueryParam("include_icon") != "1" {
+		return nil
+	}
+	icon, err := readUserIcon(owner.Name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to read owner icon: "+err.Error())
+	}
+	if len(icon) <= maxInlineIconSize {
+		owner.Icon = icon
+	}
+	return nil
+}
+
+// 配信アーカイブAPI (配信者向け)
+// PATCH /api/livestream/:livestream_id/archive
+// アーカイブした配信は検索結果に出なくなるが、ライブコメントや報告は残る
+func archiveLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req ArchiveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	isArchived := true
+	if req.IsArchived != nil {
+		isArchived = *req.IsArchived
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't archive other streamer's livestream")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET is_archived = ? WHERE id = ?", isArchived, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	livestreamModel.IsArchived = isArchived
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信情報更新API
+// PUT /api/livestream/:livestream_id
+// 配信開始前に限り、タイトル・説明文・サムネイル・タグを変更できる
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *UpdateLivestreamRequest
+	// ボディがnullだとreqがnilのままになるので、デコード失敗と同じく400にする
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if err := validateLivestreamText(req.Title, req.Description); err != nil {
+		return err
+	}
+	if req.ThumbnailUrl, err = normalizeThumbnailURL(req.ThumbnailUrl); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't update other streamer's livestream")
+	}
+	if time.Now().Unix() >= livestreamModel.StartAt {
+		return newAPIError(http.StatusConflict, "ALREADY_STARTED", "livestream has already started")
+	}
+
+	if req.Version != nil && *req.Version != livestreamModel.Version {
+		return newLivestreamVersionConflictError()
+	}
+
+	tagIDs, err := validateTagIDs(ctx, tx, req.Tags)
+	if err != nil {
+		return err
+	}
+
+	livestreamModel.Title = req.Title
+	livestreamModel.Description = req.Description
+	livestreamModel.ThumbnailUrl = req.ThumbnailUrl
+	rs, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, thumbnail_url = :thumbnail_url, version = version + 1 WHERE id = :id AND version = :version", livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	if err := checkLivestreamVersionBumped(rs, &livestreamModel); err != nil {
+		return err
+	}
+
+	if err := replaceLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// newLivestreamVersionConflictError は配信が読み込んだ後に他で変更されていたことを表すエラーを作る
+// echo.HTTPErrorはミドルウェアで書き換えられることがあるので、呼び出しごとに作る
+func newLivestreamVersionConflictError() *echo.HTTPError {
+	return newAPIError(http.StatusConflict, "VERSION_CONFLICT", "livestream was modified concurrently, please reload and retry")
+}
+
+// checkLivestreamVersionBumped は WHERE version = ? 付きのUPDATEが適用されたか確かめ、モデルのversionを進める
+// 1行も更新されなければ、その間に他で変更されたとみなして409を返す
+func checkLivestreamVersionBumped(rs sql.Result, livestreamModel *LivestreamModel) error {
+	updated, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get updated livestreams count: "+err.Error())
+	}
+	if updated == 0 {
+		return newLivestreamVersionConflictError()
+	}
+	livestreamModel.Version++
+	return nil
+}
+
+// 配信タグ削除API
+// DELETE /api/livestream/:livestream_id/tag/:tag_id
+// 配信から1つのタグを外す。include_tags=1 の場合は204ではなく、残ったタグ一覧を200で返す
+func deleteLivestreamTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "tag_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't remove tags from other streamer's livestream")
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ? AND tag_id = ?", livestreamID, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tag: "+err.Error())
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted livestream tags count: "+err.Error())
+	}
+	// 最後のタグを外した場合と区別できるよう、元々付いていないタグは404にする
+	if deleted == 0 {
+		return newAPIError(http.StatusNotFound, "TAG_NOT_ATTACHED", "the livestream does not have the tag")
+	}
+	if err := touchLivestream(ctx, tx, livestreamModel.ID); err != nil {
+		return err
+	}
+
+	var tags []Tag
+	if c.QueryParam("include_tags") == "1" {
+		tagsMap, err := getLivestreamTagsMap(ctx, tx, []int64{livestreamModel.ID})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+		tags = tagsMap[livestreamModel.ID]
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if tags != nil {
+		return c.JSON(http.StatusOK, tags)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// replaceLivestreamTags は配信のタグを指定されたものに揃える
+// 変わらないタグの行は残し、外れたタグの削除と増えたタグの追加だけを行う
+func replaceLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	var currentTagIDs []int64
+	if err := tx.SelectContext(ctx, &currentTagIDs, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	wanted := make(map[int64]struct{}, len(tagIDs))
+	for _, tagID := range tagIDs {
+		wanted[tagID] = struct{}{}
+	}
+	current := make(map[int64]struct{}, len(currentTagIDs))
+	var removedTagIDs []int64
+	for _, tagID := range currentTagIDs {
+		current[tagID] = struct{}{}
+		if _, ok := wanted[tagID]; !ok {
+			removedTagIDs = append(removedTagIDs, tagID)
+		}
+	}
+
+	if len(removedTagIDs) > 0 {
+		query, params, err := sqlx.In("DELETE FROM livestream_tags WHERE livestream_id = ? AND tag_id IN (?)", livestreamID, removedTagIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+	}
+
+	var addedTagModels []*LivestreamTagModel
+	for _, tagID := range tagIDs {
+		if _, ok := current[tagID]; ok {
+			continue
+		}
+		addedTagModels = append(addedTagModels, &LivestreamTagModel{
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		})
+	}
+	if err := insertLivestreamTags(ctx, tx, addedTagModels); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tags: "+err.Error())
+	}
+
+	return nil
+}
+
+// 配信譲渡API
+// POST /api/livestream/:livestream_id/transfer
+func transferLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *TransferLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't transfer other streamer's livestream")
+	}
+
+	var targetUser UserModel
+	if err := tx.GetContext(ctx, &targetUser, "SELECT * FROM users WHERE name = ?", req.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "USER_NOT_FOUND", "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if targetUser.ID == userID {
+		return newAPIError(http.StatusBadRequest, "SELF_TRANSFER", "can't transfer a livestream to yourself")
+	}
+	if req.Version != nil && *req.Version != livestreamModel.Version {
+		return newLivestreamVersionConflictError()
+	}
+
+	if err := setLivestreamOwner(ctx, tx, &livestreamModel, targetUser.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	rs, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET user_id = :user_id, owner_name = :owner_name, owner_display_name = :owner_display_name, owner_icon_hash = :owner_icon_hash, version = version + 1 WHERE id = :id AND version = :version", livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream owner: "+err.Error())
+	}
+	if err := checkLivestreamVersionBumped(rs, &livestreamModel); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信予約キャンセルAPI
+// DELETE /api/livestream/:livestream_id
+// 開始前の自分の配信を取り消して予約枠を戻し、空いた予約枠でキャンセル待ちを繰り上げる
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	// 予約枠をロックするので、予約と同じくデッドロック時はやり直す
+	err = retryOnLockConflict(ctx, c.Logger(), func() error {
+		return cancelLivestream(ctx, c.Logger(), userID, int64(livestreamID))
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// cancelLivestream は1回分のトランザクションで配信予約を取り消す
+func cancelLivestream(ctx context.Context, logger echo.Logger, userID, livestreamID int64) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error()).SetInternal(err)
+	}
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't cancel other streamer's livestream")
+	}
+	if livestreamModel.StartAt <= time.Now().Unix() {
+		return newAPIError(http.StatusConflict, "ALREADY_STARTED", "can't cancel a livestream that has already started")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slots: "+err.Error()).SetInternal(err)
+	}
 
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i, livestreamModel := range livestreamModels {
-		user := userMap[livestreamModel.UserID]
-		tags, ok := tagsMap[livestreamModel.ID]
-		if !ok {
-			tags = make([]Tag, 0)
+	// 開始前でもコメントなどが付いていることがあるので、配信に紐づくものはまとめて消す
+	for _, table := range []string{"livestream_tags", "livecomment_reports", "livecomments", "reactions", "ng_words", "livestream_viewers_history", "livestream_viewer_events", "livestream_watch_history", "reservation_idempotency_keys"} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete "+table+": "+err.Error()).SetInternal(err)
 		}
+	}
+	if err := recordDeletedLivestreams(ctx, tx, []int64{livestreamID}, time.Now().Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error()).SetInternal(err)
+	}
 
-		livestreams[i] = Livestream{
-			ID:           livestreamModel.ID,
-			Owner:        user,
-			Title:        livestreamModel.Title,
-			Tags:         tags,
-			Description:  livestreamModel.Description,
-			PlaylistUrl:  livestreamModel.PlaylistUrl,
-			ThumbnailUrl: livestreamModel.ThumbnailUrl,
-			StartAt:      livestreamModel.StartAt,
-			EndAt:        livestreamModel.EndAt,
-		}
+	promoted, err := promoteWaitlist(ctx, logger, tx, livestreamModel.StartAt, livestreamModel.EndAt)
+	if err != nil {
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
 	}
-
-	return c.JSON(http.StatusOK, livestreams)
+	if promoted > 0 {
+		logger.Infof("promoted %d waitlisted reservations after cancelling livestream %d", promoted, livestreamID)
+	}
+	return nil
 }
 
-func getMyLivestreamsHandler(c echo.Context) error {
+// 予約競合プレビューAPI
+// GET /api/livestream/conflicts?start_at=&end_at=
+// 指定区間と重なる自分の配信予約を返す (予約はしない)
+func getLivestreamConflictsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	startAt, err := strconv.ParseInt(c.QueryParam("start_at"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "start_at query parameter must be integer")
 	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-		}
-		livestreams[i] = livestream
+	endAt, err := strconv.ParseInt(c.QueryParam("end_at"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "end_at query parameter must be integer")
+	}
+	if startAt >= endAt {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", "bad reservation time range")
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	conflicts := []LivestreamModel{}
+	if err := tx.SelectContext(ctx, &conflicts, "SELECT * FROM livestreams WHERE user_id = ? AND start_at < ? AND end_at > ? ORDER BY start_at", userID, endAt, startAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return c.JSON(http.StatusOK, conflicts)
 }
 
-func getUserLivestreamsHandler(c echo.Context) error {
+// 1リクエストで指定できるライブ配信IDの上限
+const maxLivestreamTagsBatchSize = 200
+
+// ライブ配信タグ一括取得API
+// GET /api/livestream/tags?ids=1,2,3
+func getLivestreamTagsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
 	if err := verifyUserSession(c); err != nil {
 		return err
 	}
 
-	username := c.Param("username")
+	rawIDs := strings.Split(c.QueryParam("ids"), ",")
+	if len(rawIDs) > maxLivestreamTagsBatchSize {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", fmt.Sprintf("ids query parameter must contain at most %d ids", maxLivestreamTagsBatchSize))
+	}
+	livestreamIDs := make([]int64, 0, len(rawIDs))
+	for _, rawID := range rawIDs {
+		livestreamID, err := strconv.ParseInt(strings.TrimSpace(rawID), 10, 64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "ids query parameter must be comma-separated integers")
+		}
+		livestreamIDs = append(livestreamIDs, livestreamID)
+	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "user not found")
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
-		}
-	}
-
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-		}
-		livestreams[i] = livestream
+	tagsMap, err := getLivestreamTagsMap(ctx, tx, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return c.JSON(http.StatusOK, tagsMap)
 }
 
-// viewerテーブルの廃止
-func enterLivestreamHandler(c echo.Context) error {
+// 視聴中ユーザ一覧API (配信者向け)
+// GET /api/livestream/:livestream_id/viewers
+func getLivestreamViewersHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
 	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	limit, err := parseListLimit(c)
+	if err != nil {
 		return err
 	}
 
@@ -468,108 +2361,196 @@ func enterLivestreamHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
-	}
-
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	viewer := LivestreamViewerModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't get other streamer's livestream viewers")
 	}
 
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
+	// exitすると視聴履歴は削除されるので、残っている行が視聴中のユーザ
+	query := `
+	SELECT
+		users.*
+	FROM
+		livestream_viewers_history
+		JOIN users ON livestream_viewers_history.user_id = users.id
+	WHERE
+		livestream_viewers_history.livestream_id = ?
+	ORDER BY
+		livestream_viewers_history.created_at DESC,
+		livestream_viewers_history.id DESC
+	LIMIT ?
+	`
+
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, livestreamID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream viewers: "+err.Error())
+	}
+
+	viewers, err := fillUserResponses(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.NoContent(http.StatusOK)
+	return c.JSON(http.StatusOK, viewers)
 }
 
-func exitLivestreamHandler(c echo.Context) error {
+// 配信存在確認API
+// GET /api/livestream/:livestream_id/exists
+// 1クエリだけなのでトランザクションは張らない
+func getLivestreamExistsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
 	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	var exists int
+	if err := dbConn.GetContext(ctx, &exists, "SELECT 1 FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 配信者取得API
+// GET /api/livestream/:livestream_id/owner
+// 配信者だけが必要な画面向けに、タグなどを引かずに配信者のみを返す
+func getLivestreamOwnerHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel.UserID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	owner, err := fillLivestreamOwner(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.NoContent(http.StatusOK)
+	return c.JSON(http.StatusOK, owner)
 }
 
-func getLivestreamHandler(c echo.Context) error {
+const (
+	defaultLivecommentReportsLimit = 50
+	maxLivecommentReportsLimit     = 500
+)
+
+// セッション、配信の存在、配信者本人であることはミドルウェアで確認済み
+func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
+	livestreamModel := livestreamFromContext(c)
+	livestreamID := livestreamModel.ID
 
-	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	// before_id より古い通報を新しい順に limit 件返す
+	limit := defaultLivecommentReportsLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be positive integer")
+		}
+		if l > maxLivecommentReportsLimit {
+			l = maxLivecommentReportsLimit
+		}
+		limit = l
+	}
+	var beforeID int64
+	if v := c.QueryParam("before_id"); v != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || beforeID <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "before_id query parameter must be positive integer")
+		}
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	livestreamModel := LivestreamModel{}
-	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	conditions := []string{"livecomment_reports.livestream_id = ?"}
+	args := []interface{}{livestreamID}
+	if beforeID > 0 {
+		conditions = append(conditions, "livecomment_reports.id < ?")
+		args = append(args, beforeID)
 	}
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	// モデレーションで削除済みのコメントへの通報はLIMITの前に除き、ページがlimit件に満たなくならないようにする
+	var reportModels []LivecommentReportModel
+	query := "SELECT livecomment_reports.* FROM livecomment_reports JOIN livecomments ON livecomments.id = livecomment_reports.livecomment_id WHERE " + strings.Join(conditions, " AND ") + " ORDER BY livecomment_reports.id DESC LIMIT ?"
+	if err := tx.SelectContext(ctx, &reportModels, query, append(args, limit)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	reports, err := fillLivecommentReportResponses(ctx, tx, livestreamModel, reportModels)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment reports: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestream)
+	return c.JSON(http.StatusOK, reports)
 }
 
-func getLivecommentReportsHandler(c echo.Context) error {
+type LivecommentReportSummary struct {
+	Livecomment Livecomment `json:"livecomment"`
+	ReportCount int64       `json:"report_count"`
+	Reporters   []User      `json:"reporters"`
+}
+
+// 配信者向け通報サマリAPI
+// GET /api/livestream/:livestream_id/report/summary
+// 通報されたライブコメントごとに通報数と通報したユーザをまとめて、通報数の多い順に返す
+func getLivecommentReportSummaryHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
@@ -578,10 +2559,10 @@ func getLivecommentReportsHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -589,6 +2570,9 @@ func getLivecommentReportsHandler(c echo.Context) error {
 
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
@@ -598,68 +2582,270 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	userID := sess.Values[defaultUserIDKey].(int64)
 
 	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't get other streamer's livecomment reports")
 	}
 
-	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+	// モデレーションで削除済みのコメントへの通報は除く
+	var counts []struct {
+		LivecommentID int64 `db:"livecomment_id"`
+		ReportCount   int64 `db:"report_count"`
+	}
+	query := `
+	SELECT r.livecomment_id, COUNT(*) AS report_count
+	FROM livecomment_reports r
+	INNER JOIN livecomments l ON l.id = r.livecomment_id
+	WHERE r.livestream_id = ?
+	GROUP BY r.livecomment_id
+	ORDER BY report_count DESC, r.livecomment_id ASC
+	`
+	if err := tx.SelectContext(ctx, &counts, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomment reports: "+err.Error())
 	}
 
-	reports := make([]LivecommentReport, len(reportModels))
-	for i := range reportModels {
-		report, err := fillLivecommentReportResponse(ctx, tx, *reportModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+	summaries := make([]LivecommentReportSummary, len(counts))
+	if len(counts) == 0 {
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 		}
-		reports[i] = report
+		return c.JSON(http.StatusOK, summaries)
+	}
+
+	livecommentIDs := make([]int64, len(counts))
+	for i := range counts {
+		livecommentIDs[i] = counts[i].LivecommentID
+	}
+
+	var livecommentModels []LivecommentModel
+	query, params, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	if err := tx.SelectContext(ctx, &livecommentModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+
+	// 同じユーザが同じコメントを複数回通報していても通報者としては1人
+	var reporterPairs []struct {
+		LivecommentID int64 `db:"livecomment_id"`
+		UserID        int64 `db:"user_id"`
+		FirstID       int64 `db:"first_id"`
+	}
+	query, params, err = sqlx.In("SELECT livecomment_id, user_id, MIN(id) AS first_id FROM livecomment_reports WHERE livestream_id = ? AND livecomment_id IN (?) GROUP BY livecomment_id, user_id ORDER BY first_id", livestreamID, livecommentIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	if err := tx.SelectContext(ctx, &reporterPairs, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reporters: "+err.Error())
+	}
+
+	// コメント投稿者と通報者をまとめて取得する
+	userIDSet := make(map[int64]struct{})
+	for _, livecommentModel := range livecommentModels {
+		userIDSet[livecommentModel.UserID] = struct{}{}
+	}
+	for _, pair := range reporterPairs {
+		userIDSet[pair.UserID] = struct{}{}
+	}
+	userIDs := make([]int64, 0, len(userIDSet))
+	for id := range userIDSet {
+		userIDs = append(userIDs, id)
+	}
+	userMap, err := getUserMap(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reports)
+	livecommentMap := make(map[int64]LivecommentModel, len(livecommentModels))
+	for _, livecommentModel := range livecommentModels {
+		livecommentMap[livecommentModel.ID] = livecommentModel
+	}
+	reportersMap := make(map[int64][]User, len(livecommentIDs))
+	for _, pair := range reporterPairs {
+		reportersMap[pair.LivecommentID] = append(reportersMap[pair.LivecommentID], userMap[pair.UserID])
+	}
+
+	for i, count := range counts {
+		livecommentModel := livecommentMap[count.LivecommentID]
+		reporters, ok := reportersMap[count.LivecommentID]
+		if !ok {
+			reporters = make([]User, 0)
+		}
+		summaries[i] = LivecommentReportSummary{
+			Livecomment: Livecomment{
+				ID:         livecommentModel.ID,
+				User:       userMap[livecommentModel.UserID],
+				Livestream: livestream,
+				Comment:    livecommentModel.Comment,
+				Tip:        livecommentModel.Tip,
+				CreatedAt:  livecommentModel.CreatedAt,
+			},
+			ReportCount: count.ReportCount,
+			Reporters:   reporters,
+		}
+	}
+
+	return c.JSON(http.StatusOK, summaries)
 }
 
+// fillLivestreamResponseで毎回実行するクエリ
+// 文字列をキーにプリペアドステートメントをキャッシュする
+const (
+	fillLivestreamOwnerQuery         = "SELECT * FROM users WHERE id = ?"
+	fillLivestreamTagsQuery          = "SELECT tag_id FROM livestream_tags WHERE livestream_id = ? ORDER BY id"
+	fillLivestreamCommentsCountQuery = "SELECT COUNT(*) FROM livecomments WHERE livestream_id = ?"
+)
+
 func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
-	ownerModel := UserModel{}
-	if err := tx.GetContext(ctx, &ownerModel, "SELECT * FROM users WHERE id = ?", livestreamModel.UserID); err != nil {
+	livestream, err := fillLivestreamResponseWithoutOwner(ctx, tx, livestreamModel)
+	if err != nil {
 		return Livestream{}, err
 	}
-	owner, err := fillUserResponse(ctx, tx, ownerModel)
+	livestream.Owner, err = fillLivestreamOwner(ctx, tx, livestreamModel)
 	if err != nil {
 		return Livestream{}, err
 	}
+	return livestream, nil
+}
 
-	var livestreamTagModels []*LivestreamTagModel
-	if err := tx.SelectContext(ctx, &livestreamTagModels, "SELECT * FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+func fillLivestreamResponseWithoutOwner(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
+	livestream, err := fillLivestreamScalars(ctx, tx, livestreamModel)
+	if err != nil {
 		return Livestream{}, err
 	}
+	livestream.Tags, err = fillLivestreamTags(ctx, tx, livestreamModel)
+	if err != nil {
+		return Livestream{}, err
+	}
+	return livestream, nil
+}
 
-	tags := make([]Tag, len(livestreamTagModels))
-	for i := range livestreamTagModels {
-		tagModel := TagModel{}
-		if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ?", livestreamTagModels[i].TagID); err != nil {
-			return Livestream{}, err
-		}
+// fillLivestreamOwner は配信者をUserとして取得する
+func fillLivestreamOwner(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (User, error) {
+	ownerStmt, err := preparedStmts.txStmt(ctx, tx, fillLivestreamOwnerQuery)
+	if err != nil {
+		return User{}, err
+	}
+	ownerModel := UserModel{}
+	if err := ownerStmt.GetContext(ctx, &ownerModel, livestreamModel.UserID); err != nil {
+		return User{}, err
+	}
+	return fillUserResponse(ctx, tx, ownerModel)
+}
 
-		tags[i] = Tag{
-			ID:   tagModel.ID,
-			Name: tagModel.Name,
-		}
+// fillLivestreamTags は配信のタグを付けた順に取得する
+func fillLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) ([]Tag, error) {
+	tagsStmt, err := preparedStmts.txStmt(ctx, tx, fillLivestreamTagsQuery)
+	if err != nil {
+		return nil, err
+	}
+	var tagIDs []int64
+	if err := tagsStmt.SelectContext(ctx, &tagIDs, livestreamModel.ID); err != nil {
+		return nil, err
+	}
+	return tagsCache.resolve(ctx, tagIDs)
+}
+
+// fillLivestreamScalars は配信者とタグ以外を埋めた配信を返す
+func fillLivestreamScalars(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
+	commentsCountStmt, err := preparedStmts.txStmt(ctx, tx, fillLivestreamCommentsCountQuery)
+	if err != nil {
+		return Livestream{}, err
+	}
+	var commentsCount int64
+	if err := commentsCountStmt.GetContext(ctx, &commentsCount, livestreamModel.ID); err != nil {
+		return Livestream{}, err
 	}
 
+	state := livestreamState(livestreamModel.StartAt, livestreamModel.EndAt, requestTime(ctx))
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:             livestreamModel.ID,
+		Title:          livestreamModel.Title,
+		Description:    livestreamModel.Description,
+		PlaylistUrl:    livestreamModel.PlaylistUrl,
+		ThumbnailUrl:   livestreamModel.ThumbnailUrl,
+		StartAt:        livestreamModel.StartAt,
+		EndAt:          livestreamModel.EndAt,
+		CreatedAt:      livestreamModel.CreatedAt,
+		IsArchived:     livestreamModel.IsArchived,
+		ViewersCount:   livestreamModel.CurrentViewers,
+		ReactionsCount: livestreamModel.ReactionsCount,
+		State:          state,
+		IsLive:         state == livestreamStateLive,
+		CommentsCount:  commentsCount,
+		Version:        livestreamModel.Version,
 	}
 	return livestream, nil
 }
+
+// getLivestreamCommentsCounts は配信ごとのライブコメント数をまとめて取得する
+func getLivestreamCommentsCounts(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64]int64, error) {
+	commentsCountMap := make(map[int64]int64, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return commentsCountMap, nil
+	}
+
+	var counts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"count"`
+	}
+	query, params, err := sqlx.In("SELECT livestream_id, COUNT(*) AS count FROM livecomments WHERE livestream_id IN (?) GROUP BY livestream_id", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &counts, query, params...); err != nil {
+		return nil, err
+	}
+	for _, count := range counts {
+		commentsCountMap[count.LivestreamID] = count.Count
+	}
+
+	return commentsCountMap, nil
+}
+
+// getLivestreamTagsMap は複数配信のタグをまとめて取得する
+// すべての配信IDについて、タグがなくても空のスライスを入れて返す
+func getLivestreamTagsMap(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64][]Tag, error) {
+	tagsMap := make(map[int64][]Tag, len(livestreamIDs))
+	for _, livestreamID := range livestreamIDs {
+		tagsMap[livestreamID] = make([]Tag, 0)
+	}
+	if len(livestreamIDs) == 0 {
+		return tagsMap, nil
+	}
+
+	var livestreamTagModels []*LivestreamTagModel
+	query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?) ORDER BY id", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &livestreamTagModels, query, params...); err != nil {
+		return nil, err
+	}
+
+	tagIDs := make([]int64, len(livestreamTagModels))
+	for i, livestreamTagModel := range livestreamTagModels {
+		tagIDs[i] = livestreamTagModel.TagID
+	}
+	tags, err := tagsCache.lookup(ctx, tagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, livestreamTagModel := range livestreamTagModels {
+		tag, ok := tags[livestreamTagModel.TagID]
+		if !ok {
+			continue
+		}
+		tagsMap[livestreamTagModel.LivestreamID] = append(tagsMap[livestreamTagModel.LivestreamID], tag)
+	}
+	return tagsMap, nil
+}
@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// postTestReservation はuserIDのセッションで配信予約APIを呼び、ステータスコードとレスポンスを返す
+func postTestReservation(t *testing.T, userID int64, req ReserveLivestreamRequest) (int, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to encode request: %+v", err)
+	}
+	c, rec := newTestContext(t, http.MethodPost, "/api/livestream/reservation", bytes.NewReader(body), userID)
+	return responseStatus(reserveLivestreamHandler(c), rec), rec
+}
+
+func TestEnterLivestreamTwiceKeepsOneViewerRow(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	viewerID := insertTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, ownerID, "live", now-60, now+3600)
+
+	for i := 0; i < 2; i++ {
+		c, rec := newTestContext(t, http.MethodPost, "/api/livestream/"+strconv.FormatInt(livestreamID, 10)+"/enter", nil, viewerID)
+		c.SetParamNames("livestream_id")
+		c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+		err := sessionMiddleware(livestreamMiddleware(enterLivestreamHandler))(c)
+		if status := responseStatus(err, rec); status != http.StatusOK {
+			t.Fatalf("enter #%d: status = %d, want %d (err=%v)", i+1, status, http.StatusOK, err)
+		}
+	}
+
+	var rows int
+	if err := dbConn.Get(&rows, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); err != nil {
+		t.Fatalf("failed to count viewer rows: %+v", err)
+	}
+	if rows != 1 {
+		t.Errorf("livestream_viewers_history rows = %d, want 1", rows)
+	}
+	var currentViewers int64
+	if err := dbConn.Get(&currentViewers, "SELECT current_viewers FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		t.Fatalf("failed to get current_viewers: %+v", err)
+	}
+	if currentViewers != 1 {
+		t.Errorf("current_viewers = %d, want 1", currentViewers)
+	}
+}
+
+func TestEnterLivestreamConcurrentlyKeepsOneViewerRow(t *testing.T) {
+	setupTestDB(t)
+
+	const n = 10
+	ownerID := insertTestUser(t, "owner")
+	viewerID := insertTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, ownerID, "live", now-60, now+3600)
+
+	// t.Fatalfを呼びうる準備はテストのgoroutineで済ませておく
+	contexts := make([]echo.Context, n)
+	recs := make([]*httptest.ResponseRecorder, n)
+	for i := range contexts {
+		contexts[i], recs[i] = newTestContext(t, http.MethodPost, "/api/livestream/"+strconv.FormatInt(livestreamID, 10)+"/enter", nil, viewerID)
+		contexts[i].SetParamNames("livestream_id")
+		contexts[i].SetParamValues(strconv.FormatInt(livestreamID, 10))
+	}
+
+	statuses := make([]int, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range contexts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			statuses[i] = responseStatus(sessionMiddleware(livestreamMiddleware(enterLivestreamHandler))(contexts[i]), recs[i])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("enter #%d: status = %d, want %d", i+1, status, http.StatusOK)
+		}
+	}
+	var rows int
+	if err := dbConn.Get(&rows, "SELECT COUNT(*) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", viewerID, livestreamID); err != nil {
+		t.Fatalf("failed to count viewer rows: %+v", err)
+	}
+	if rows != 1 {
+		t.Errorf("livestream_viewers_history rows = %d, want 1", rows)
+	}
+	var currentViewers int64
+	if err := dbConn.Get(&currentViewers, "SELECT current_viewers FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		t.Fatalf("failed to get current_viewers: %+v", err)
+	}
+	if currentViewers != 1 {
+		t.Errorf("current_viewers = %d, want 1", currentViewers)
+	}
+}
+
+func TestReserveLivestreamRejectsRangeAcrossSlotBoundary(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	insertTestSlots(t, baseAt, baseAt+3*3600, 5)
+
+	// 1枠目の途中から3枠目の途中まで
+	status, _ := postTestReservation(t, userID, ReserveLivestreamRequest{
+		Title:       "misaligned",
+		PlaylistUrl: "https://media.example.com/live.m3u8",
+		StartAt:     baseAt + 1800,
+		EndAt:       baseAt + 1800 + 2*3600,
+	})
+	if status != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	var remaining int64
+	if err := dbConn.Get(&remaining, "SELECT SUM(slot) FROM reservation_slots"); err != nil {
+		t.Fatalf("failed to sum slots: %+v", err)
+	}
+	if remaining != 3*5 {
+		t.Errorf("remaining slots = %d, want %d", remaining, 3*5)
+	}
+	var livestreams int
+	if err := dbConn.Get(&livestreams, "SELECT COUNT(*) FROM livestreams"); err != nil {
+		t.Fatalf("failed to count livestreams: %+v", err)
+	}
+	if livestreams != 0 {
+		t.Errorf("livestreams = %d, want 0", livestreams)
+	}
+}
+
+func TestSearchLivestreamsStartAscBreaksTiesByID(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	laterID := insertTestLivestream(t, userID, "later", baseAt+7200, baseAt+10800)
+	firstID := insertTestLivestream(t, userID, "first", baseAt, baseAt+3600)
+	tiedID := insertTestLivestream(t, userID, "tied", baseAt, baseAt+3600)
+
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/search?sort=start_asc", nil, 0)
+	if status := responseStatus(searchLivestreamsHandler(c), rec); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+
+	var livestreams []Livestream
+	if err := json.Unmarshal(rec.Body.Bytes(), &livestreams); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	want := []int64{firstID, tiedID, laterID}
+	if len(livestreams) != len(want) {
+		t.Fatalf("got %d livestreams, want %d", len(livestreams), len(want))
+	}
+	for i, livestream := range livestreams {
+		if livestream.ID != want[i] {
+			t.Errorf("livestreams[%d].id = %d, want %d", i, livestream.ID, want[i])
+		}
+	}
+}
+
+func TestSearchLivestreamsRejectsUnknownSort(t *testing.T) {
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/search?sort=random", nil, 0)
+	if status := responseStatus(searchLivestreamsHandler(c), rec); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestEscapeLikePattern(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "100%", want: `100\%`},
+		{in: "a_b", want: `a\_b`},
+		{in: `C:\path`, want: `C:\\path`},
+		{in: `%_\`, want: `\%\_\\`},
+	} {
+		if got := escapeLikePattern(tt.in); got != tt.want {
+			t.Errorf("escapeLikePattern(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSearchLivestreamsTitleWithPercent(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	matchedID := insertTestLivestream(t, userID, "50% OFF sale", baseAt, baseAt+3600)
+	// エスケープしないと "50% off" の%がワイルドカードになって一致してしまう
+	insertTestLivestream(t, userID, "500 OFF sale", baseAt, baseAt+3600)
+
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/search?q="+url.QueryEscape("50% off"), nil, 0)
+	if status := responseStatus(searchLivestreamsHandler(c), rec); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	var livestreams []Livestream
+	if err := json.Unmarshal(rec.Body.Bytes(), &livestreams); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(livestreams) != 1 || livestreams[0].ID != matchedID {
+		t.Errorf("got %+v, want only livestream %d", livestreams, matchedID)
+	}
+}
+
+func TestValidateLivestreamText(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		title       string
+		description string
+		wantErr     bool
+	}{
+		{name: "title at limit", title: strings.Repeat("あ", maxLivestreamTitleLength)},
+		{name: "title over limit", title: strings.Repeat("あ", maxLivestreamTitleLength+1), wantErr: true},
+		{name: "description at limit", description: strings.Repeat("説", maxLivestreamDescriptionLength)},
+		{name: "description over limit", description: strings.Repeat("説", maxLivestreamDescriptionLength+1), wantErr: true},
+		// バイト数では上限を超えていても文字数で数える
+		{name: "multibyte title within limit", title: strings.Repeat("配信", maxLivestreamTitleLength/2)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLivestreamText(tt.title, tt.description)
+			if tt.wantErr {
+				if status := responseStatus(err, nil); err == nil || status != http.StatusBadRequest {
+					t.Errorf("err = %v, want 400", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestUpdateLivestreamRejectsNullBody(t *testing.T) {
+	c, rec := newTestContext(t, http.MethodPut, "/api/livestream/1", strings.NewReader("null"), 1)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues("1")
+	if status := responseStatus(updateLivestreamHandler(c), rec); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestReserveLivestreamDuplicateTags(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	rs, err := dbConn.Exec("INSERT INTO tags (name) VALUES ('ライブ配信')")
+	if err != nil {
+		t.Fatalf("failed to insert tag: %+v", err)
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get inserted tag id: %+v", err)
+	}
+	tagsCache.invalidate()
+	baseAt := reservationTermStartAt.Unix()
+	insertTestSlots(t, baseAt, baseAt+3600, 5)
+
+	status, rec := postTestReservation(t, userID, ReserveLivestreamRequest{
+		Tags:        []int64{tagID, tagID},
+		Title:       "duplicate tags",
+		PlaylistUrl: "https://media.example.com/live.m3u8",
+		StartAt:     baseAt,
+		EndAt:       baseAt + 3600,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("status = %d, want %d (body=%s)", status, http.StatusCreated, rec.Body.String())
+	}
+	var livestream Livestream
+	if err := json.Unmarshal(rec.Body.Bytes(), &livestream); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(livestream.Tags) != 1 || livestream.Tags[0].ID != tagID {
+		t.Errorf("tags = %+v, want only tag %d", livestream.Tags, tagID)
+	}
+
+	var rows int
+	if err := dbConn.Get(&rows, "SELECT COUNT(*) FROM livestream_tags WHERE livestream_id = ?", livestream.ID); err != nil {
+		t.Fatalf("failed to count livestream_tags: %+v", err)
+	}
+	if rows != 1 {
+		t.Errorf("livestream_tags rows = %d, want 1", rows)
+	}
+}
+
+func TestValidateReservationDuration(t *testing.T) {
+	const baseAt = 1700000000
+	for _, tt := range []struct {
+		name    string
+		startAt int64
+		endAt   int64
+		wantErr bool
+	}{
+		{name: "start equals end", startAt: baseAt, endAt: baseAt, wantErr: true},
+		{name: "end before start", startAt: baseAt, endAt: baseAt - 3600, wantErr: true},
+		{name: "shorter than minimum", startAt: baseAt, endAt: baseAt + 1800, wantErr: true},
+		{name: "minimum", startAt: baseAt, endAt: baseAt + int64(minLivestreamDuration.Seconds())},
+		{name: "maximum", startAt: baseAt, endAt: baseAt + int64(maxLivestreamDuration.Seconds())},
+		{name: "longer than maximum", startAt: baseAt, endAt: baseAt + int64(maxLivestreamDuration.Seconds()) + 3600, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReservationDuration(tt.startAt, tt.endAt)
+			if tt.wantErr {
+				if status := responseStatus(err, nil); err == nil || status != http.StatusBadRequest {
+					t.Errorf("err = %v, want 400", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestSearchLivestreamsWithoutFallbackImage(t *testing.T) {
+	setupTestDB(t)
+
+	// 代わりの画像が読めなくても、アイコン未登録のユーザを含む検索は成功する
+	prevFallbackImage := fallbackImage
+	fallbackImage = t.TempDir() + "/missing.jpg"
+	t.Cleanup(func() { fallbackImage = prevFallbackImage })
+
+	userID := insertTestUser(t, "no_icon")
+	baseAt := reservationTermStartAt.Unix()
+	insertTestLivestream(t, userID, "live", baseAt, baseAt+3600)
+
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/search", nil, 0)
+	if status := responseStatus(searchLivestreamsHandler(c), rec); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	var livestreams []Livestream
+	if err := json.Unmarshal(rec.Body.Bytes(), &livestreams); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if len(livestreams) != 1 {
+		t.Fatalf("got %d livestreams, want 1", len(livestreams))
+	}
+	if livestreams[0].Owner.IconHash != fallbackImageHash {
+		t.Errorf("owner icon_hash = %q, want %q", livestreams[0].Owner.IconHash, fallbackImageHash)
+	}
+}
+
+func TestReserveLivestreamMiddleSlotFull(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	insertTestSlots(t, baseAt, baseAt+3*3600, 5)
+	middleStartAt, middleEndAt := baseAt+3600, baseAt+2*3600
+	if _, err := dbConn.Exec("UPDATE reservation_slots SET slot = 0 WHERE start_at = ?", middleStartAt); err != nil {
+		t.Fatalf("failed to fill the middle slot: %+v", err)
+	}
+
+	body, err := json.Marshal(ReserveLivestreamRequest{
+		Title:       "across the full slot",
+		PlaylistUrl: "https://media.example.com/live.m3u8",
+		StartAt:     baseAt,
+		EndAt:       baseAt + 3*3600,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode request: %+v", err)
+	}
+	c, rec := newTestContext(t, http.MethodPost, "/api/livestream/reservation", bytes.NewReader(body), userID)
+	err = reserveLivestreamHandler(c)
+	if status := responseStatus(err, rec); status != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+	// どの枠が埋まっているかをメッセージで示す
+	wantSlot := fmt.Sprintf("予約枠 %d ~ %d", middleStartAt, middleEndAt)
+	if !strings.Contains(err.Error(), wantSlot) {
+		t.Errorf("error = %q, want it to name %q", err.Error(), wantSlot)
+	}
+
+	var slots []int64
+	if err := dbConn.Select(&slots, "SELECT slot FROM reservation_slots ORDER BY start_at"); err != nil {
+		t.Fatalf("failed to get slots: %+v", err)
+	}
+	for i, want := range []int64{5, 0, 5} {
+		if slots[i] != want {
+			t.Errorf("slot[%d] = %d, want %d", i, slots[i], want)
+		}
+	}
+}
+
+func TestValidateReservationTermAtJSTBoundaries(t *testing.T) {
+	jst, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("failed to load Asia/Tokyo: %+v", err)
+	}
+	at := func(year int, month time.Month, day, hour int) int64 {
+		return time.Date(year, month, day, hour, 0, 0, 0, jst).Unix()
+	}
+	// 期間は 2023-11-25 10:00 JST ~ 2024-11-25 10:00 JST (UTCでは各日の01:00)
+	for _, tt := range []struct {
+		name    string
+		startAt int64
+		endAt   int64
+		wantErr bool
+	}{
+		// JSTでは11/25だが、期間の開始前
+		{name: "first JST day before term start", startAt: at(2023, 11, 25, 0), endAt: at(2023, 11, 25, 10), wantErr: true},
+		{name: "ends just after term start", startAt: at(2023, 11, 25, 9), endAt: at(2023, 11, 25, 11)},
+		{name: "starts at term start", startAt: at(2023, 11, 25, 10), endAt: at(2023, 11, 25, 11)},
+		{name: "JST midnight before term start", startAt: at(2023, 11, 24, 23), endAt: at(2023, 11, 25, 0), wantErr: true},
+		{name: "ends at term end", startAt: at(2024, 11, 25, 9), endAt: at(2024, 11, 25, 10)},
+		{name: "starts at term end", startAt: at(2024, 11, 25, 10), endAt: at(2024, 11, 25, 11), wantErr: true},
+		// JSTでは11/25だが、期間の終了後
+		{name: "last JST day after term end", startAt: at(2024, 11, 25, 12), endAt: at(2024, 11, 26, 0), wantErr: true},
+		{name: "JST midnight of last day", startAt: at(2024, 11, 25, 0), endAt: at(2024, 11, 25, 1)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// 判定はunix時刻で行うので、表示用のタイムゾーンによらず同じ結果になる
+			for _, loc := range []*time.Location{time.UTC, jst} {
+				err := validateReservationTerm(tt.startAt, tt.endAt, loc)
+				if tt.wantErr {
+					if status := responseStatus(err, nil); err == nil || status != http.StatusBadRequest {
+						t.Errorf("tz=%s: err = %v, want 400", loc, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("tz=%s: err = %v, want nil", loc, err)
+				}
+			}
+		})
+	}
+
+	// エラーメッセージの期間はリクエストのタイムゾーンで表示する
+	for _, tt := range []struct {
+		loc  *time.Location
+		want []string
+	}{
+		{loc: time.UTC, want: []string{"2023-11-25T01:00:00Z", "2024-11-25T01:00:00Z"}},
+		{loc: jst, want: []string{"2023-11-25T10:00:00+09:00", "2024-11-25T10:00:00+09:00"}},
+	} {
+		err := validateReservationTerm(at(2023, 11, 25, 0), at(2023, 11, 25, 10), tt.loc)
+		if err == nil {
+			t.Fatalf("tz=%s: err = nil, want 400", tt.loc)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("tz=%s: error = %q, want it to contain %q", tt.loc, err.Error(), want)
+			}
+		}
+	}
+}
+
+func TestParseReservationTimezone(t *testing.T) {
+	for _, tt := range []struct {
+		tz      string
+		want    string
+		wantErr bool
+	}{
+		{tz: "", want: "UTC"},
+		{tz: "Asia/Tokyo", want: "Asia/Tokyo"},
+		{tz: "Not/AZone", wantErr: true},
+	} {
+		c, _ := newTestContext(t, http.MethodPost, "/api/livestream/reservation?tz="+url.QueryEscape(tt.tz), nil, 0)
+		loc, err := parseReservationTimezone(c)
+		if tt.wantErr {
+			if status := responseStatus(err, nil); err == nil || status != http.StatusBadRequest {
+				t.Errorf("tz=%q: err = %v, want 400", tt.tz, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tz=%q: err = %v, want nil", tt.tz, err)
+			continue
+		}
+		if loc.String() != tt.want {
+			t.Errorf("tz=%q: location = %s, want %s", tt.tz, loc, tt.want)
+		}
+	}
+}
+
+func TestGetUserLivestreamsPagesWithAfterID(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	var ids []int64
+	for i := int64(0); i < 3; i++ {
+		ids = append(ids, insertTestLivestream(t, userID, fmt.Sprintf("stream %d", i), baseAt+i*3600, baseAt+(i+1)*3600))
+	}
+
+	type page struct {
+		Items      []Livestream `json:"items"`
+		NextCursor *int64       `json:"next_cursor"`
+	}
+	getPage := func(query string) ([]int64, *int64) {
+		t.Helper()
+		c, rec := newTestContext(t, http.MethodGet, "/api/user/streamer/livestream?"+query, nil, userID)
+		c.SetParamNames("username")
+		c.SetParamValues("streamer")
+		if status := responseStatus(getUserLivestreamsHandler(c), rec); status != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", query, status, http.StatusOK)
+		}
+		var res page
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to decode response: %+v", err)
+		}
+		gotIDs := make([]int64, len(res.Items))
+		for i, livestream := range res.Items {
+			gotIDs[i] = livestream.ID
+		}
+		return gotIDs, res.NextCursor
+	}
+
+	got, cursor := getPage("limit=2&envelope=1")
+	if len(got) != 2 || got[0] != ids[0] || got[1] != ids[1] {
+		t.Fatalf("first page = %v, want %v", got, ids[:2])
+	}
+	if cursor == nil || *cursor != ids[1] {
+		t.Fatalf("next_cursor = %v, want %d", cursor, ids[1])
+	}
+
+	got, cursor = getPage("limit=2&envelope=1&after_id=" + strconv.FormatInt(*cursor, 10))
+	if len(got) != 1 || got[0] != ids[2] {
+		t.Fatalf("second page = %v, want %v", got, ids[2:])
+	}
+	if cursor != nil {
+		t.Errorf("next_cursor = %d, want null", *cursor)
+	}
+}
+
+func TestSearchLivestreamsEnvelopeOmitsCursorForStartSort(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	insertTestLivestream(t, userID, "first", baseAt, baseAt+3600)
+	insertTestLivestream(t, userID, "second", baseAt+3600, baseAt+7200)
+
+	for _, tt := range []struct {
+		sort       string
+		wantCursor bool
+	}{
+		{sort: "newest", wantCursor: true},
+		{sort: "oldest", wantCursor: true},
+		// start_at順の続きはafter_idで取れない
+		{sort: "start_asc", wantCursor: false},
+		{sort: "start_desc", wantCursor: false},
+	} {
+		c, rec := newTestContext(t, http.MethodGet, "/api/livestream/search?envelope=1&limit=1&sort="+tt.sort, nil, 0)
+		if status := responseStatus(searchLivestreamsHandler(c), rec); status != http.StatusOK {
+			t.Fatalf("sort=%s: status = %d, want %d", tt.sort, status, http.StatusOK)
+		}
+		var res ListEnvelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to decode response: %+v", err)
+		}
+		if got := res.NextCursor != nil; got != tt.wantCursor {
+			t.Errorf("sort=%s: has next_cursor = %v, want %v", tt.sort, got, tt.wantCursor)
+		}
+	}
+}
+
+func TestBuildInsertLivestreamTagsQuery(t *testing.T) {
+	query, args, ok, err := buildInsertLivestreamTagsQuery([]*LivestreamTagModel{
+		{LivestreamID: 1, TagID: 10},
+		{LivestreamID: 1, TagID: 20},
+		{LivestreamID: 1, TagID: 30},
+	})
+	if err != nil || !ok {
+		t.Fatalf("buildInsertLivestreamTagsQuery() = %v, %v, want ok", ok, err)
+	}
+	// 1回のINSERTで全行を追加する
+	const wantQuery = "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?),(?, ?),(?, ?)"
+	if query != wantQuery {
+		t.Errorf("query = %q, want %q", query, wantQuery)
+	}
+	wantArgs := []interface{}{int64(1), int64(10), int64(1), int64(20), int64(1), int64(30)}
+	if fmt.Sprint(args) != fmt.Sprint(wantArgs) || len(args) != len(wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+
+	for _, models := range [][]*LivestreamTagModel{nil, {}} {
+		query, args, ok, err := buildInsertLivestreamTagsQuery(models)
+		if ok || err != nil || query != "" || args != nil {
+			t.Errorf("buildInsertLivestreamTagsQuery(%v) = %q, %v, %v, %v, want nothing to insert", models, query, args, ok, err)
+		}
+	}
+}
+
+func TestGetUserLivestreamsNotModified(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	livestreamID := insertTestLivestream(t, userID, "live", createdAt.Unix(), createdAt.Unix()+3600)
+	if _, err := dbConn.Exec("UPDATE livestreams SET created_at = ? WHERE id = ?", createdAt.Unix(), livestreamID); err != nil {
+		t.Fatalf("failed to set created_at: %+v", err)
+	}
+
+	get := func(username string, ifModifiedSince time.Time) (int, *httptest.ResponseRecorder) {
+		t.Helper()
+		c, rec := newTestContext(t, http.MethodGet, "/api/user/"+username+"/livestream", nil, userID)
+		c.Request().Header.Set(echo.HeaderIfModifiedSince, ifModifiedSince.UTC().Format(http.TimeFormat))
+		c.SetParamNames("username")
+		c.SetParamValues(username)
+		return responseStatus(getUserLivestreamsHandler(c), rec), rec
+	}
+
+	status, rec := get("streamer", createdAt)
+	if status != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", status, http.StatusNotModified)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("body = %q, want empty", rec.Body.String())
+	}
+
+	status, rec = get("streamer", createdAt.Add(-time.Second))
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if got, want := rec.Header().Get(echo.HeaderLastModified), createdAt.UTC().Format(http.TimeFormat); got != want {
+		t.Errorf("Last-Modified = %q, want %q", got, want)
+	}
+
+	// 存在しないユーザはキャッシュの確認より先に404になる
+	if status, _ := get("nobody", time.Now()); status != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestFillLivestreamResponsesOwnerWithoutTheme(t *testing.T) {
+	setupTestDB(t)
+
+	// themesの行がないユーザ
+	rs, err := dbConn.Exec("INSERT INTO users (name, display_name, password, description) VALUES ('nothemes', 'No Themes', '', '')")
+	if err != nil {
+		t.Fatalf("failed to insert user: %+v", err)
+	}
+	userID, err := rs.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get inserted user id: %+v", err)
+	}
+	themedUserID := insertTestUser(t, "themed")
+	baseAt := reservationTermStartAt.Unix()
+	insertTestLivestream(t, userID, "without theme", baseAt, baseAt+3600)
+	insertTestLivestream(t, themedUserID, "with theme", baseAt, baseAt+3600)
+
+	ctx := context.Background()
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams ORDER BY id"); err != nil {
+		t.Fatalf("failed to get livestreams: %+v", err)
+	}
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		t.Fatalf("failed to fill livestreams: %+v", err)
+	}
+
+	if len(livestreams) != 2 {
+		t.Fatalf("got %d livestreams, want 2", len(livestreams))
+	}
+	// テーマのないユーザも落とさず、Themeはゼロ値にする
+	owner := livestreams[0].Owner
+	if owner.ID != userID || owner.Name != "nothemes" {
+		t.Errorf("owner = %+v, want user %d", owner, userID)
+	}
+	if owner.Theme != (Theme{}) {
+		t.Errorf("owner.theme = %+v, want zero value", owner.Theme)
+	}
+	if owner.IconHash != fallbackImageHash {
+		t.Errorf("owner.icon_hash = %q, want the fallback hash", owner.IconHash)
+	}
+	if themed := livestreams[1].Owner; themed.ID != themedUserID || themed.Theme.ID == 0 {
+		t.Errorf("themed owner = %+v, want user %d with a theme", themed, themedUserID)
+	}
+}
+
+func TestReserveLivestreamConcurrentlyDoesNotOverbook(t *testing.T) {
+	setupTestDB(t)
+
+	const n = 20
+	userID := insertTestUser(t, "streamer")
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + 3600
+	insertTestSlots(t, startAt, endAt, 1)
+
+	// t.Fatalfを呼びうる準備はテストのgoroutineで済ませておく
+	contexts := make([]echo.Context, n)
+	recs := make([]*httptest.ResponseRecorder, n)
+	for i := range contexts {
+		body, err := json.Marshal(ReserveLivestreamRequest{
+			Tags:        []int64{},
+			Title:       fmt.Sprintf("concurrent %d", i),
+			PlaylistUrl: "https://media.example.com/live.m3u8",
+			StartAt:     startAt,
+			EndAt:       endAt,
+		})
+		if err != nil {
+			t.Fatalf("failed to encode request: %+v", err)
+		}
+		contexts[i], recs[i] = newTestContext(t, http.MethodPost, "/api/livestream/reservation", bytes.NewReader(body), userID)
+	}
+
+	statuses := make([]int, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range contexts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			statuses[i] = responseStatus(reserveLivestreamHandler(contexts[i]), recs[i])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var created, rejected int
+	for i, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusBadRequest:
+			rejected++
+		default:
+			t.Errorf("reservation %d: status = %d, want 201 or 400", i, status)
+		}
+	}
+	if created != 1 || rejected != n-1 {
+		t.Errorf("created = %d, rejected = %d, want 1 and %d", created, rejected, n-1)
+	}
+
+	var slot int64
+	if err := dbConn.Get(&slot, "SELECT slot FROM reservation_slots WHERE start_at = ?", startAt); err != nil {
+		t.Fatalf("failed to get slot: %+v", err)
+	}
+	if slot != 0 {
+		t.Errorf("slot = %d, want 0", slot)
+	}
+	var livestreams int
+	if err := dbConn.Get(&livestreams, "SELECT COUNT(*) FROM livestreams WHERE user_id = ?", userID); err != nil {
+		t.Fatalf("failed to count livestreams: %+v", err)
+	}
+	if livestreams != 1 {
+		t.Errorf("livestreams = %d, want 1", livestreams)
+	}
+}
+
+func TestReserveLivestreamWaitlistedRetryWithSameIdempotencyKey(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + 3600
+	insertTestSlots(t, startAt, endAt, 0)
+
+	reserve := func() (int, *httptest.ResponseRecorder) {
+		t.Helper()
+		body, err := json.Marshal(ReserveLivestreamRequest{
+			Tags:        []int64{},
+			Title:       "waitlisted",
+			PlaylistUrl: "https://media.example.com/live.m3u8",
+			StartAt:     startAt,
+			EndAt:       endAt,
+			Waitlist:    true,
+		})
+		if err != nil {
+			t.Fatalf("failed to encode request: %+v", err)
+		}
+		c, rec := newTestContext(t, http.MethodPost, "/api/livestream/reservation", bytes.NewReader(body), userID)
+		c.Request().Header.Set(idempotencyKeyHeader, "retry-key")
+		return responseStatus(reserveLivestreamHandler(c), rec), rec
+	}
+
+	var entries [2]ReservationWaitlistEntry
+	for i := range entries {
+		status, rec := reserve()
+		if status != http.StatusAccepted {
+			t.Fatalf("reservation #%d: status = %d, want %d (body=%s)", i+1, status, http.StatusAccepted, rec.Body.String())
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&entries[i]); err != nil {
+			t.Fatalf("failed to decode waitlist entry: %+v", err)
+		}
+	}
+	if entries[0].ID != entries[1].ID {
+		t.Errorf("waitlist ids = %d, %d, want the same entry", entries[0].ID, entries[1].ID)
+	}
+	var waitlisted int
+	if err := dbConn.Get(&waitlisted, "SELECT COUNT(*) FROM reservation_waitlist WHERE user_id = ?", userID); err != nil {
+		t.Fatalf("failed to count waitlist: %+v", err)
+	}
+	if waitlisted != 1 {
+		t.Errorf("waitlist entries = %d, want 1", waitlisted)
+	}
+
+	// 繰り上がった後の再送には、繰り上がった配信を返す
+	if _, err := dbConn.Exec("UPDATE reservation_slots SET slot = 1 WHERE start_at = ?", startAt); err != nil {
+		t.Fatalf("failed to free slot: %+v", err)
+	}
+	tx, err := dbConn.Beginx()
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	promoted, err := promoteWaitlist(context.Background(), echo.New().Logger, tx, startAt, endAt)
+	if err != nil {
+		t.Fatalf("failed to promote waitlist: %+v", err)
+	}
+	if promoted != 1 {
+		t.Fatalf("promoted = %d, want 1", promoted)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit: %+v", err)
+	}
+
+	status, rec := reserve()
+	if status != http.StatusCreated {
+		t.Fatalf("retry after promotion: status = %d, want %d (body=%s)", status, http.StatusCreated, rec.Body.String())
+	}
+	var livestreams int
+	if err := dbConn.Get(&livestreams, "SELECT COUNT(*) FROM livestreams WHERE user_id = ?", userID); err != nil {
+		t.Fatalf("failed to count livestreams: %+v", err)
+	}
+	if livestreams != 1 {
+		t.Errorf("livestreams = %d, want 1", livestreams)
+	}
+}
+
+func TestGetLivestreamViewersRejectsNegativeLimit(t *testing.T) {
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/1/viewers?limit=-1", nil, 1)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues("1")
+	if status := responseStatus(getLivestreamViewersHandler(c), rec); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestCancelLivestreamDeletesViewerEvents(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	viewerID := insertTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, ownerID, "upcoming", now+3600, now+7200)
+	if _, err := dbConn.Exec("INSERT INTO livestream_viewer_events (livestream_id, user_id, delta, created_at) VALUES (?, ?, 1, ?)", livestreamID, viewerID, now); err != nil {
+		t.Fatalf("failed to insert viewer event: %+v", err)
+	}
+
+	if err := cancelLivestream(context.Background(), echo.New().Logger, ownerID, livestreamID); err != nil {
+		t.Fatalf("failed to cancel livestream: %+v", err)
+	}
+
+	var events int
+	if err := dbConn.Get(&events, "SELECT COUNT(*) FROM livestream_viewer_events WHERE livestream_id = ?", livestreamID); err != nil {
+		t.Fatalf("failed to count viewer events: %+v", err)
+	}
+	if events != 0 {
+		t.Errorf("livestream_viewer_events rows = %d, want 0", events)
+	}
+}
+
+func TestGetUserLivestreamsNotModifiedWithFutureLegacyLivestream(t *testing.T) {
+	setupTestDB(t)
+
+	// 追加時刻のない古い配信で、開始が未来のもの
+	userID := insertTestUser(t, "streamer")
+	startAt := time.Now().Add(24 * time.Hour).Unix()
+	livestreamID := insertTestLivestream(t, userID, "legacy", startAt, startAt+3600)
+	if _, err := dbConn.Exec("UPDATE livestreams SET created_at = 0 WHERE id = ?", livestreamID); err != nil {
+		t.Fatalf("failed to clear created_at: %+v", err)
+	}
+
+	get := func(ifModifiedSince string) (int, *httptest.ResponseRecorder) {
+		t.Helper()
+		c, rec := newTestContext(t, http.MethodGet, "/api/user/streamer/livestream", nil, userID)
+		if ifModifiedSince != "" {
+			c.Request().Header.Set(echo.HeaderIfModifiedSince, ifModifiedSince)
+		}
+		c.SetParamNames("username")
+		c.SetParamValues("streamer")
+		return responseStatus(getUserLivestreamsHandler(c), rec), rec
+	}
+
+	status, rec := get("")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	lastModified := rec.Header().Get(echo.HeaderLastModified)
+	if want := reservationTermStartAt.UTC().Format(http.TimeFormat); lastModified != want {
+		t.Errorf("Last-Modified = %q, want %q", lastModified, want)
+	}
+
+	if status, _ := get(lastModified); status != http.StatusNotModified {
+		t.Errorf("revalidation status = %d, want %d", status, http.StatusNotModified)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// livestreamMiddlewareでcontextに入れた配信のキー
+const livestreamContextKey = "livestream"
+
+// sessionMiddleware はverifyUserSessionでログイン済みか確かめる
+// livestreamMiddlewareより前に置き、配信の有無より先に未ログインを401にする
+func sessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := verifyUserSession(c); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
+
+// livestreamMiddleware はパスの:livestream_idの配信を読み込み、contextに入れる
+// IDが整数でなければ400、配信がなければ404を返す
+func livestreamMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+		}
+
+		var livestreamModel LivestreamModel
+		if err := dbConn.GetContext(c.Request().Context(), &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		c.Set(livestreamContextKey, livestreamModel)
+		return next(c)
+	}
+}
+
+// livestreamOwnerMiddleware はlivestreamMiddlewareで読み込んだ配信の配信者本人でなければ403を返す
+// sessionMiddlewareとlivestreamMiddlewareの後に置く
+func livestreamOwnerMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+
+		if livestreamFromContext(c).UserID != userID {
+			return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't access other streamer's livestream")
+		}
+		return next(c)
+	}
+}
+
+// livestreamFromContext はlivestreamMiddlewareで読み込んだ配信を返す
+func livestreamFromContext(c echo.Context) LivestreamModel {
+	return c.Get(livestreamContextKey).(LivestreamModel)
+}
@@ -4,20 +4,26 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	// "github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/sync/singleflight"
 
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	// echolog "github.com/labstack/gommon/log"
 )
@@ -25,12 +31,46 @@ import (
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	reservationRateLimitEnvKey     = "ISUCON13_RESERVATION_RATE_LIMIT_PER_MINUTE"
+	defaultThumbnailURLEnvKey      = "ISUCON13_DEFAULT_THUMBNAIL_URL"
+	maxRequestBodyBytesEnvKey      = "ISUCON13_MAX_REQUEST_BODY_BYTES"
+	adminTokenEnvKey               = "ISUCON13_ADMIN_TOKEN"
+	gzipMinLengthEnvKey            = "ISUCON13_GZIP_MIN_LENGTH"
+	gzipLevelEnvKey                = "ISUCON13_GZIP_LEVEL"
+	corsAllowOriginsEnvKey         = "ISUCON13_CORS_ALLOW_ORIGINS"
+	shutdownTimeoutEnvKey          = "ISUCON13_SHUTDOWN_TIMEOUT"
+	searchCacheTTLEnvKey           = "ISUCON13_SEARCH_CACHE_TTL"
+	playlistAllowedHostsEnvKey     = "ISUCON13_PLAYLIST_ALLOWED_HOSTS"
+	queryDeadlineEnvKey            = "ISUCON13_QUERY_DEADLINE"
+	defaultListLimitEnvKey         = "ISUCON13_DEFAULT_LIST_LIMIT"
+	maxListLimitEnvKey             = "ISUCON13_MAX_LIST_LIMIT"
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 1ユーザあたり1分間に可能な配信予約数 (デフォルトは無制限)
+	reservationRateLimiter = newRateLimiter(0, time.Minute)
+	// サムネイル未設定の配信に使うサムネイル
+	defaultThumbnailURL = "https://media.xiii.isucon.dev/isucon12_final.webp"
+	// POST/PUT/PATCHで受け付けるリクエストボディの上限バイト数
+	maxRequestBodyBytes int64 = 1 << 20
+	// 管理者用APIのトークン (未設定なら管理者用APIは無効)
+	adminToken string
+	// このバイト数以上のレスポンスをgzip圧縮する
+	gzipMinLength = 1024
+	// gzipの圧縮レベル (-1はデフォルト)
+	gzipLevel = -1
+	// CORSで許可するオリジン (未設定ならCORSヘッダを返さない)
+	corsAllowOrigins []string
+	// 終了時に処理中のリクエストを待つ時間
+	shutdownTimeout = 10 * time.Second
+	// プレイリストURLとして許可するホスト (未設定ならホストは制限しない)
+	playlistAllowedHosts []string
+	// 配信一覧APIでlimit省略時に返す件数と、limitで指定できる上限
+	defaultListLimit = 100
+	maxListLimit     = 1000
 )
 
 func init() {
@@ -38,6 +78,91 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv(reservationRateLimitEnvKey); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as int: %+v", reservationRateLimitEnvKey, err)
+		}
+		reservationRateLimiter = newRateLimiter(limit, time.Minute)
+	}
+	if v, ok := os.LookupEnv(defaultThumbnailURLEnvKey); ok {
+		defaultThumbnailURL = v
+	}
+	adminToken = os.Getenv(adminTokenEnvKey)
+	if v, ok := os.LookupEnv(gzipMinLengthEnvKey); ok {
+		minLength, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as int: %+v", gzipMinLengthEnvKey, err)
+		}
+		gzipMinLength = minLength
+	}
+	if v, ok := os.LookupEnv(gzipLevelEnvKey); ok {
+		level, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as int: %+v", gzipLevelEnvKey, err)
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			log.Fatalf("environment variable '%s' must be between %d and %d", gzipLevelEnvKey, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+		gzipLevel = level
+	}
+	if v, ok := os.LookupEnv(maxRequestBodyBytesEnvKey); ok {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as int: %+v", maxRequestBodyBytesEnvKey, err)
+		}
+		maxRequestBodyBytes = limit
+	}
+	if v, ok := os.LookupEnv(shutdownTimeoutEnvKey); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as duration: %+v", shutdownTimeoutEnvKey, err)
+		}
+		shutdownTimeout = timeout
+	}
+	if v, ok := os.LookupEnv(searchCacheTTLEnvKey); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as duration: %+v", searchCacheTTLEnvKey, err)
+		}
+		searchCache = newSearchResultCache(ttl)
+	}
+	if v, ok := os.LookupEnv(queryDeadlineEnvKey); ok {
+		deadline, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse environment variable '%s' as duration: %+v", queryDeadlineEnvKey, err)
+		}
+		queryDeadline = deadline
+	}
+	if v, ok := os.LookupEnv(defaultListLimitEnvKey); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			log.Fatalf("environment variable '%s' must be non-negative integer", defaultListLimitEnvKey)
+		}
+		defaultListLimit = limit
+	}
+	if v, ok := os.LookupEnv(maxListLimitEnvKey); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			log.Fatalf("environment variable '%s' must be non-negative integer", maxListLimitEnvKey)
+		}
+		maxListLimit = limit
+	}
+	if defaultListLimit > maxListLimit {
+		defaultListLimit = maxListLimit
+	}
+	if v, ok := os.LookupEnv(playlistAllowedHostsEnvKey); ok {
+		playlistAllowedHosts = parseCommaSeparatedList(v)
+	}
+	if v, ok := os.LookupEnv(corsAllowOriginsEnvKey); ok {
+		corsAllowOrigins = parseCommaSeparatedList(v)
+		for _, origin := range corsAllowOrigins {
+			// credentialsを許可するので、すべてのオリジンを許可することはできない
+			if origin == "*" {
+				log.Fatalf("environment variable '%s' must list origins explicitly, not '*'", corsAllowOriginsEnvKey)
+			}
+		}
+	}
 }
 
 type InitializeResponse struct {
@@ -53,6 +178,10 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
 		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+
+		maxOpenConnsEnvKey    = "ISUCON13_MYSQL_MAX_OPEN_CONNS"
+		maxIdleConnsEnvKey    = "ISUCON13_MYSQL_MAX_IDLE_CONNS"
+		connMaxLifetimeEnvKey = "ISUCON13_MYSQL_CONN_MAX_LIFETIME"
 	)
 
 	conf := mysql.NewConfig()
@@ -97,7 +226,37 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(10)
+
+	// コネクションプールの設定
+	// アイドル接続を開き直すコストを避けるため、アイドル数は最大接続数と揃える
+	var (
+		maxOpenConns    = 10
+		maxIdleConns    = 10
+		connMaxLifetime = 3 * time.Minute
+	)
+	if v, ok := os.LookupEnv(maxOpenConnsEnvKey); ok {
+		maxOpenConns, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as int: %+v", maxOpenConnsEnvKey, err)
+		}
+	}
+	if v, ok := os.LookupEnv(maxIdleConnsEnvKey); ok {
+		maxIdleConns, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as int: %+v", maxIdleConnsEnvKey, err)
+		}
+	}
+	if v, ok := os.LookupEnv(connMaxLifetimeEnvKey); ok {
+		connMaxLifetime, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as duration: %+v", connMaxLifetimeEnvKey, err)
+		}
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
+	// echoのロガーはERROR未満を出さないので、標準のlogで起動時に必ず出す
+	log.Printf("db connection pool: max_open_conns=%d max_idle_conns=%d conn_max_lifetime=%s", maxOpenConns, maxIdleConns, connMaxLifetime)
 
 	if err := db.Ping(); err != nil {
 		return nil, err
@@ -106,11 +265,71 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	return db, nil
 }
 
+// beginReadOnlyTx は参照系ハンドラ向けに読み取り専用のトランザクションを開始する
+// START TRANSACTION READ ONLY になるので、書き込みロックやコミットのコストを抑えられる
+func beginReadOnlyTx(ctx context.Context) (*sqlx.Tx, error) {
+	return dbConn.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+}
+
+// runSharedReadOnly は複数のリクエストで結果を共有する問い合わせを、専用の読み取り専用トランザクションで実行する
+// 呼び出し元のリクエストから切り離したcontextを使うので、先に始めたリクエストが切断されても待っている側は巻き込まれない
+// 切り離した分の締め切りは、リクエストと同じqueryDeadlineにする
+func runSharedReadOnly(ctx context.Context, fn func(ctx context.Context, tx *sqlx.Tx) error) error {
+	ctx = context.WithoutCancel(ctx)
+	if queryDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryDeadline)
+		defer cancel()
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// waitShared はsingleflightで共有している処理の結果を待つ
+// 待っている間に自分のリクエストのcontextが終われば、共有している処理を残して先に戻る
+func waitShared(ctx context.Context, ch <-chan singleflight.Result) (interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if errors.Is(r.Err, context.DeadlineExceeded) {
+			// 共有している処理の締め切りは先に始めたリクエストに合わせているので、後から待ち始めた側には自分の締め切りより先に来る
+			return nil, newAPIErrorWithInternal(http.StatusServiceUnavailable, "TIMEOUT", "request timed out, please retry later", r.Err)
+		}
+		return r.Val, r.Err
+	}
+}
+
 func initializeHandler(c echo.Context) error {
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
+	// 初期データでタグも入れ直されるので読み直す
+	if err := tagsCache.refresh(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
+	if err := backfillIconHashes(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to backfill icon hashes: "+err.Error())
+	}
+	if err := backfillLivestreamOwners(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to backfill livestream owners: "+err.Error())
+	}
+	if _, err := reconcileViewerCounts(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile viewer counts: "+err.Error())
+	}
+	if _, err := reconcileReactionCounts(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile reaction counts: "+err.Error())
+	}
 	os.RemoveAll("../img/icon")
 	os.Mkdir("../img/icon", 0750)
 
@@ -125,9 +344,32 @@ func main() {
 	// e.Debug = true
 	// e.Logger.SetLevel(echolog.DEBUG)
 	// e.Use(middleware.Logger())
-	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.dev"
-	e.Use(session.Middleware(cookieStore))
+	sessionStore, err := newSessionStore()
+	if err != nil {
+		e.Logger.Errorf("failed to set up session store: %v", err)
+		os.Exit(1)
+	}
+	e.Use(inFlightMiddleware)
+	e.Use(requestIDMiddleware)
+	e.Use(requestTimeMiddleware)
+	if len(corsAllowOrigins) > 0 {
+		e.Use(corsMiddleware(corsAllowOrigins))
+	}
+	e.Use(requestMetrics.middleware)
+	e.Use(session.Middleware(sessionStore))
+	e.Use(bodyLimitMiddleware(maxRequestBodyBytes))
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		// アイコン画像は圧縮済みのバイナリ、WebSocketは接続を乗っ取るので圧縮しない
+		Skipper: func(c echo.Context) bool {
+			switch c.Path() {
+			case "/api/user/:username/icon", "/api/livestream/:livestream_id/ws":
+				return true
+			}
+			return false
+		},
+		Level:     gzipLevel,
+		MinLength: gzipMinLength,
+	}))
 	// e.Use(middleware.Recover())
 
 	// 初期化
@@ -135,26 +377,66 @@ func main() {
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	e.GET("/api/tag/popular", getPopularTagsHandler)
+	e.GET("/api/tag/trending", getTrendingTagsHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
-	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.POST("/api/livestream/reservation", reserveLivestreamHandler, queryDeadlineMiddleware)
+	// 配信の一括予約 (すべて予約できた場合のみ予約する)
+	e.POST("/api/livestream/reserve/batch", reserveLivestreamBatchHandler, queryDeadlineMiddleware)
+	// 予約枠の仮押さえと確定
+	e.POST("/api/livestream/reservation/hold", holdReservationHandler, queryDeadlineMiddleware)
+	e.POST("/api/livestream/reservation/hold/:token/confirm", confirmReservationHoldHandler)
+	// 予約前に自分の配信との競合を確認
+	e.GET("/api/livestream/conflicts", getLivestreamConflictsHandler)
 	// list livestream
-	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/search", searchLivestreamsHandler, queryDeadlineMiddleware)
+	// 全ユーザの配信フィード
+	e.GET("/api/livestream/feed", getLivestreamFeedHandler)
+	// リアクション数ランキング
+	e.GET("/api/livestream/ranking", getReactionRankingHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	e.GET("/api/user/:username/livestreams.rss", getUserLivestreamsRSSHandler)
+	// 複数配信のタグをまとめて取得
+	e.GET("/api/livestream/tags", getLivestreamTagsHandler)
 	// get livestream
-	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.GET("/api/livestream/:livestream_id", getLivestreamHandler, sessionMiddleware, livestreamMiddleware)
+	e.GET("/api/livestream/:livestream_id/exists", getLivestreamExistsHandler)
+	// 配信者のみ取得
+	e.GET("/api/livestream/:livestream_id/owner", getLivestreamOwnerHandler)
+	e.HEAD("/api/livestream/:livestream_id/exists", getLivestreamExistsHandler)
+	// 共通するタグの多い関連配信
+	e.GET("/api/livestream/:livestream_id/related", getRelatedLivestreamsHandler)
+	// 配信開始前の配信情報更新
+	e.PUT("/api/livestream/:livestream_id", updateLivestreamHandler)
+	// 配信予約キャンセル (キャンセル待ちがあれば繰り上げる)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id/tag/:tag_id", deleteLivestreamTagHandler)
+	// 配信のアーカイブ/アーカイブ解除
+	e.PATCH("/api/livestream/:livestream_id/archive", archiveLivestreamHandler)
+	// 配信の譲渡
+	e.POST("/api/livestream/:livestream_id/transfer", transferLivestreamHandler)
+	// 配信複製
+	e.POST("/api/livestream/:livestream_id/clone", cloneLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	// ライブコメントのCSV出力 (配信者向け)
+	e.GET("/api/livestream/:livestream_id/livecomments.csv", exportLivecommentsCSVHandler, sessionMiddleware, livestreamMiddleware, livestreamOwnerMiddleware)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	// 新着ライブコメントのpush
+	e.GET("/api/livestream/:livestream_id/ws", livecommentWebSocketHandler, sessionMiddleware, livestreamMiddleware)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	// リアクション内訳 (配信者向け)
+	e.GET("/api/livestream/:livestream_id/reactions/summary", getReactionSummaryHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
-	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
+	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler, sessionMiddleware, livestreamMiddleware, livestreamOwnerMiddleware)
+	e.GET("/api/livestream/:livestream_id/report/summary", getLivecommentReportSummaryHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
@@ -163,16 +445,33 @@ func main() {
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
-	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler, sessionMiddleware, livestreamMiddleware)
 	// ユーザ視聴終了 (viewer)
-	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler, sessionMiddleware, livestreamMiddleware)
+	// 再接続時の視聴再開 (viewer)
+	e.POST("/api/livestream/:livestream_id/resume", resumeLivestreamHandler)
+	// 視聴中ユーザ一覧 (配信者向け)
+	e.GET("/api/livestream/:livestream_id/viewers", getLivestreamViewersHandler)
+	// 視聴者数の推移 (配信者向け)
+	e.GET("/api/livestream/:livestream_id/viewers/timeline", getLivestreamViewerTimelineHandler, sessionMiddleware, livestreamMiddleware, livestreamOwnerMiddleware)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	// 配信者ダッシュボード
+	e.GET("/api/me/dashboard", getDashboardHandler)
+	// フォロー中の配信者の配信
+	e.GET("/api/me/following/livestreams", getFollowingLivestreamsHandler)
+	// 視聴履歴
+	e.GET("/api/me/history", getWatchHistoryHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
+	// コメント一覧などで必要なユーザをまとめて取得する
+	e.POST("/api/users/resolve", resolveUsersHandler)
+	// フォロー/フォロー解除
+	e.POST("/api/user/:username/follow", followUserHandler)
+	e.DELETE("/api/user/:username/follow", unfollowUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
@@ -184,6 +483,25 @@ func main() {
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
+	// 管理者用API
+	admin := e.Group("/api/admin", adminAuthMiddleware)
+	admin.POST("/tag/alias", postTagAliasHandler)
+	admin.POST("/reconcile-slots", reconcileSlotsHandler)
+	admin.POST("/reconcile-reactions", reconcileReactionCountsHandler)
+	admin.POST("/ng-words", postGlobalNGWordHandler)
+	admin.POST("/ng-words/reload", reloadGlobalNGWordsHandler)
+	admin.POST("/reservation-slots", adjustReservationSlotsHandler)
+	admin.GET("/reservation-slots/utilization", getReservationSlotUtilizationHandler)
+	admin.GET("/livestreams/longest", getLongestLivestreamsHandler)
+	admin.DELETE("/user/:username", purgeUserHandler)
+
+	// ヘルスチェック
+	e.GET("/healthz", getHealthzHandler)
+	e.GET("/livez", getLivezHandler)
+
+	// エンドポイントごとのレイテンシ・ステータスコード (Prometheus形式)
+	e.GET("/metrics", getMetricsHandler)
+
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
@@ -194,6 +512,17 @@ func main() {
 	}
 	defer conn.Close()
 	dbConn = conn
+	defer preparedStmts.close()
+
+	// リクエストを受け付ける前にタグを読み込んでおく
+	if err := tagsCache.refresh(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load tags: %v", err)
+		os.Exit(1)
+	}
+	if err := globalNGWords.reload(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load global ng words: %v", err)
+		os.Exit(1)
+	}
 
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
@@ -202,28 +531,87 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	go reservationRateLimiter.runSweeper()
+	go runReservationHoldExpirer(e.Logger)
+	go runViewerCountReconciler(e.Logger)
+	go runGlobalNGWordsWatcher(e.Logger)
+
 	// HTTPサーバ起動
+	// 終了シグナルを受けたら処理中のリクエストを待ってから戻り、deferでDB接続を閉じる
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	if err := startWithGracefulShutdown(e, listenAddr, shutdownTimeout); err != nil {
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
 	}
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+const (
+	// MySQLの重複キーエラー (ER_DUP_ENTRY)
+	mysqlErrDuplicateEntry = 1062
+	// ロック待ちのタイムアウト (ER_LOCK_WAIT_TIMEOUT)
+	mysqlErrLockWaitTimeout = 1205
+	// デッドロックの検出 (ER_LOCK_DEADLOCK)
+	mysqlErrLockDeadlock = 1213
+)
+
+// isDuplicateEntryError はユニーク制約違反のエラーかどうかを返す
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
 }
 
-func errorResponseHandler(err error, c echo.Context) {
-	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
-	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
-			c.Logger().Errorf("%+v", e)
+// isLockConflictError はデッドロックかロック待ちタイムアウトで失敗したかどうかを返す
+// echo.HTTPErrorに包まれている場合はInternalに入れた元のエラーを見る
+func isLockConflictError(err error) bool {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		if he.Internal == nil {
+			return false
 		}
-		return
+		err = he.Internal
 	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == mysqlErrLockDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+}
 
-	if e := c.JSON(http.StatusInternalServerError, &ErrorResponse{Error: err.Error()}); e != nil {
+const (
+	lockConflictMaxRetries = 3
+	lockConflictBaseDelay  = 10 * time.Millisecond
+)
+
+// retryOnLockConflict はfnがデッドロック等で失敗した場合に、少し待ってからやり直す
+// fnはトランザクションの開始からコミットまでを行い、何度呼ばれても問題ないようにすること
+// やり直しても成功しなければ503を返す
+func retryOnLockConflict(ctx context.Context, logger echo.Logger, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isLockConflictError(err) {
+			return err
+		}
+		if attempt >= lockConflictMaxRetries {
+			logger.Warnf("giving up after %d retries on lock conflict: %+v", attempt, err)
+			return newAPIError(http.StatusServiceUnavailable, "LOCK_CONFLICT", "too many concurrent requests, please retry later")
+		}
+
+		// 同時にやり直した処理同士で再び衝突しないよう、待ち時間をずらす
+		delay := lockConflictBaseDelay<<attempt + time.Duration(rand.Int63n(int64(lockConflictBaseDelay)))
+		logger.Infof("retrying after lock conflict (attempt %d): %+v", attempt+1, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// errorResponseHandler はエラーを {"error":{"code":"...","message":"..."}} の形で返す
+func errorResponseHandler(err error, c echo.Context) {
+	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
+	status, detail := newErrorDetail(err)
+	if e := c.JSON(status, &ErrorResponse{Error: detail}); e != nil {
 		c.Logger().Errorf("%+v", e)
 	}
 }
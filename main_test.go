@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestRetryOnLockConflictRetriesDeadlock(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: mysqlErrLockDeadlock, Message: "Deadlock found when trying to get lock"}
+
+	calls := 0
+	err := retryOnLockConflict(context.Background(), echo.New().Logger, func() error {
+		calls++
+		if calls == 1 {
+			// ハンドラと同じく、HTTPErrorのInternalに元のエラーを入れて返す
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot").SetInternal(deadlock)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestRetryOnLockConflictGivesUp(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "Lock wait timeout exceeded"}
+
+	calls := 0
+	err := retryOnLockConflict(context.Background(), echo.New().Logger, func() error {
+		calls++
+		return deadlock
+	})
+	if status := responseStatus(err, nil); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d (err=%v)", status, http.StatusServiceUnavailable, err)
+	}
+	if _, detail := newErrorDetail(err); detail.Code != "LOCK_CONFLICT" {
+		t.Errorf("code = %s, want LOCK_CONFLICT", detail.Code)
+	}
+	if calls != lockConflictMaxRetries+1 {
+		t.Errorf("calls = %d, want %d", calls, lockConflictMaxRetries+1)
+	}
+}
+
+func TestRetryOnLockConflictDoesNotRetryOtherErrors(t *testing.T) {
+	errOther := errors.New("other")
+
+	calls := 0
+	err := retryOnLockConflict(context.Background(), echo.New().Logger, func() error {
+		calls++
+		return errOther
+	})
+	if !errors.Is(err, errOther) {
+		t.Errorf("err = %v, want %v", err, errOther)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestWaitSharedReturnsWhenCallerContextEnds(t *testing.T) {
+	var group singleflight.Group
+	release := make(chan struct{})
+	defer close(release)
+	ch := group.DoChan("key", func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := waitShared(ctx, ch); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestWaitSharedConvertsSharedDeadlineToTimeout(t *testing.T) {
+	var group singleflight.Group
+	ch := group.DoChan("key", func() (interface{}, error) {
+		return nil, context.DeadlineExceeded
+	})
+
+	_, err := waitShared(context.Background(), ch)
+	if status, detail := newErrorDetail(err); status != http.StatusServiceUnavailable || detail.Code != "TIMEOUT" {
+		t.Errorf("newErrorDetail() = %d %s, want %d TIMEOUT", status, detail.Code, http.StatusServiceUnavailable)
+	}
+}
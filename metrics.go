@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// レイテンシのヒストグラムのバケット (秒)
+// Prometheusクライアントのデフォルトと同じ区切り
+var metricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type statusKey struct {
+	routeKey
+	code int
+}
+
+type latencyHistogram struct {
+	// bucketsはmetricsLatencyBucketsの各区切り以下だった件数 (累積ではない)
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// httpMetrics はエンドポイントごとのレイテンシとステータスコードを集計する
+// ラベルの種類が増えすぎないよう、実際のパスではなくルートのパターンで集計する
+type httpMetrics struct {
+	mu        sync.Mutex
+	latencies map[routeKey]*latencyHistogram
+	statuses  map[statusKey]uint64
+}
+
+var requestMetrics = &httpMetrics{
+	latencies: make(map[routeKey]*latencyHistogram),
+	statuses:  make(map[statusKey]uint64),
+}
+
+func (m *httpMetrics) observe(method, route string, code int, elapsed time.Duration) {
+	key := routeKey{method: method, route: route}
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.latencies[key]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]uint64, len(metricsLatencyBuckets))}
+		m.latencies[key] = h
+	}
+	for i, le := range metricsLatencyBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+
+	m.statuses[statusKey{routeKey: key, code: code}]++
+}
+
+// middleware はハンドラの処理時間とステータスコードを記録する
+func (m *httpMetrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// 監視・ヘルスチェック用のエンドポイントは集計しない
+		route := c.Path()
+		switch route {
+		case "/metrics", "/healthz", "/livez":
+			return next(c)
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+
+		start := time.Now()
+		err := next(c)
+		elapsed := time.Since(start)
+
+		// エラーはこの後HTTPErrorHandlerでレスポンスになるので、ここで返るステータスコードを求める
+		code := c.Response().Status
+		if err != nil {
+			code = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			}
+		}
+		m.observe(c.Request().Method, route, code, elapsed)
+		return err
+	}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricsFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write はPrometheusのテキスト形式で集計結果を書き出す
+func (m *httpMetrics) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	routeKeys := make([]routeKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		if routeKeys[i].route != routeKeys[j].route {
+			return routeKeys[i].route < routeKeys[j].route
+		}
+		return routeKeys[i].method < routeKeys[j].method
+	})
+
+	sb.WriteString("# HELP http_request_duration_seconds HTTP request latencies in seconds.\n")
+	sb.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, key := range routeKeys {
+		h := m.latencies[key]
+		labels := fmt.Sprintf(`method="%s",route="%s"`, metricsLabelEscaper.Replace(key.method), metricsLabelEscaper.Replace(key.route))
+		var cumulative uint64
+		for i, le := range metricsLatencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(sb, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatMetricsFloat(le), cumulative)
+		}
+		fmt.Fprintf(sb, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(sb, "http_request_duration_seconds_sum{%s} %s\n", labels, formatMetricsFloat(h.sum))
+		fmt.Fprintf(sb, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	statusKeys := make([]statusKey, 0, len(m.statuses))
+	for key := range m.statuses {
+		statusKeys = append(statusKeys, key)
+	}
+	sort.Slice(statusKeys, func(i, j int) bool {
+		if statusKeys[i].route != statusKeys[j].route {
+			return statusKeys[i].route < statusKeys[j].route
+		}
+		if statusKeys[i].method != statusKeys[j].method {
+			return statusKeys[i].method < statusKeys[j].method
+		}
+		return statusKeys[i].code < statusKeys[j].code
+	})
+
+	sb.WriteString("# HELP http_requests_total Total number of HTTP requests by status code.\n")
+	sb.WriteString("# TYPE http_requests_total counter\n")
+	for _, key := range statusKeys {
+		fmt.Fprintf(sb, "http_requests_total{method=\"%s\",route=\"%s\",code=\"%d\"} %d\n",
+			metricsLabelEscaper.Replace(key.method), metricsLabelEscaper.Replace(key.route), key.code, m.statuses[key])
+	}
+}
+
+// メトリクスAPI
+// GET /metrics
+func getMetricsHandler(c echo.Context) error {
+	var sb strings.Builder
+	requestMetrics.write(&sb)
+	writeSharedFillMetrics(&sb)
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(sb.String()))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type PurgeUserResponse struct {
+	UserID int64 `json:"user_id"`
+	// Deleted はテーブルごとに削除した行数
+	Deleted map[string]int64 `json:"deleted"`
+	// RestoredSlotTerms は予約枠を戻した予約・仮押さえの数 (開始前の配信と仮押さえ)
+	RestoredSlotTerms int `json:"restored_slot_terms"`
+}
+
+// ユーザ削除API (管理者用)
+// DELETE /api/admin/user/:username
+// 迷惑行為への対応として、ユーザとその配信・コメント・リアクション・視聴履歴などをまとめて消す
+// 開始前の配信と仮押さえの予約枠は戻し、空いた枠でキャンセル待ちを繰り上げる
+func purgeUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	// 予約枠をロックするので、予約と同じくデッドロック時はやり直す
+	var res PurgeUserResponse
+	err := retryOnLockConflict(ctx, c.Logger(), func() error {
+		var err error
+		res, err = purgeUser(ctx, c.Logger(), username)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove("../img/icon/" + username); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.Logger().Warnf("failed to remove icon of purged user %s: %+v", username, err)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// purgeUser は1回分のトランザクションでユーザとその持ち物を消す
+func purgeUser(ctx context.Context, logger echo.Logger, username string) (PurgeUserResponse, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var user UserModel
+	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ? FOR UPDATE", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PurgeUserResponse{}, newAPIError(http.StatusNotFound, "USER_NOT_FOUND", "not found user that has the given username")
+		}
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error()).SetInternal(err)
+	}
+
+	res := PurgeUserResponse{
+		UserID:  user.ID,
+		Deleted: map[string]int64{},
+	}
+	del := func(table, query string, args ...interface{}) error {
+		rs, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete "+table+": "+err.Error()).SetInternal(err)
+		}
+		n, err := rs.RowsAffected()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted "+table+" count: "+err.Error()).SetInternal(err)
+		}
+		res.Deleted[table] += n
+		return nil
+	}
+
+	// 予約枠を戻す区間。開始前の配信と、まだ残っている仮押さえが予約枠を消費している
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? FOR UPDATE", user.ID); err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error()).SetInternal(err)
+	}
+	var holds []ReservationHoldModel
+	if err := tx.SelectContext(ctx, &holds, "SELECT * FROM reservation_holds WHERE user_id = ? FOR UPDATE", user.ID); err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_holds: "+err.Error()).SetInternal(err)
+	}
+	type term struct{ startAt, endAt int64 }
+	var terms []term
+	now := time.Now().Unix()
+	for _, livestreamModel := range livestreamModels {
+		if livestreamModel.StartAt > now {
+			terms = append(terms, term{livestreamModel.StartAt, livestreamModel.EndAt})
+		}
+	}
+	for _, hold := range holds {
+		terms = append(terms, term{hold.StartAt, hold.EndAt})
+	}
+
+	// 他の配信の視聴者数カウンタからも、このユーザの入室分を引いておく
+	var viewing []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"count"`
+	}
+	if err := tx.SelectContext(ctx, &viewing, "SELECT livestream_id, COUNT(*) AS count FROM livestream_viewers_history WHERE user_id = ? GROUP BY livestream_id", user.ID); err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_viewers_history: "+err.Error()).SetInternal(err)
+	}
+	for _, v := range viewing {
+		if err := adjustCurrentViewers(ctx, tx, v.LivestreamID, v.Count, 0); err != nil {
+			return PurgeUserResponse{}, err
+		}
+		if err := recordViewerEvent(ctx, tx, v.LivestreamID, user.ID, -v.Count, now); err != nil {
+			return PurgeUserResponse{}, err
+		}
+	}
+
+	// 他の配信のリアクション数カウンタからも、このユーザのリアクション分を引いておく
+	var reacted []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"count"`
+	}
+	if err := tx.SelectContext(ctx, &reacted, "SELECT livestream_id, COUNT(*) AS count FROM reactions WHERE user_id = ? GROUP BY livestream_id", user.ID); err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error()).SetInternal(err)
+	}
+	for _, r := range reacted {
+		if err := adjustReactionsCount(ctx, tx, r.LivestreamID, -r.Count); err != nil {
+			return PurgeUserResponse{}, err
+		}
+	}
+
+	// 他の配信に投稿したコメントも消すので、それらの配信のコメント数が変わったことを検索のETagに反映する
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET updated_at = CURRENT_TIMESTAMP(6) WHERE id IN (SELECT livestream_id FROM livecomments WHERE user_id = ?)", user.ID); err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to touch livestreams: "+err.Error()).SetInternal(err)
+	}
+
+	// 参照される側が先に消えないよう、参照している側から消す
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamIDs[i] = livestreamModel.ID
+	}
+	if err := purgeLivestreamsContent(ctx, tx, livestreamIDs, del); err != nil {
+		return PurgeUserResponse{}, err
+	}
+	// 他の配信に投稿したコメントへの通報、コメント、リアクションなど
+	if err := del("livecomment_reports", "DELETE livecomment_reports FROM livecomment_reports JOIN livecomments ON livecomments.id = livecomment_reports.livecomment_id WHERE livecomments.user_id = ?", user.ID); err != nil {
+		return PurgeUserResponse{}, err
+	}
+	for _, table := range []string{"livecomment_reports", "livecomments", "reactions", "ng_words", "livestream_viewers_history", "livestream_watch_history", "reservation_idempotency_keys", "reservation_holds", "reservation_waitlist"} {
+		if err := del(table, "DELETE FROM "+table+" WHERE user_id = ?", user.ID); err != nil {
+			return PurgeUserResponse{}, err
+		}
+	}
+	if err := del("follows", "DELETE FROM follows WHERE follower_id = ? OR followee_id = ?", user.ID, user.ID); err != nil {
+		return PurgeUserResponse{}, err
+	}
+	if err := recordDeletedLivestreams(ctx, tx, livestreamIDs, now); err != nil {
+		return PurgeUserResponse{}, err
+	}
+	if err := del("livestreams", "DELETE FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+		return PurgeUserResponse{}, err
+	}
+	for _, table := range []string{"icons", "themes"} {
+		if err := del(table, "DELETE FROM "+table+" WHERE user_id = ?", user.ID); err != nil {
+			return PurgeUserResponse{}, err
+		}
+	}
+	if err := del("users", "DELETE FROM users WHERE id = ?", user.ID); err != nil {
+		return PurgeUserResponse{}, err
+	}
+
+	// 予約枠を戻してからキャンセル待ちを繰り上げる
+	promoted := 0
+	for _, t := range terms {
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", t.startAt, t.endAt); err != nil {
+			return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slots: "+err.Error()).SetInternal(err)
+		}
+	}
+	for _, t := range terms {
+		n, err := promoteWaitlist(ctx, logger, tx, t.startAt, t.endAt)
+		if err != nil {
+			return PurgeUserResponse{}, err
+		}
+		promoted += n
+	}
+	res.RestoredSlotTerms = len(terms)
+
+	if err := tx.Commit(); err != nil {
+		return PurgeUserResponse{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+	}
+	if promoted > 0 {
+		logger.Infof("promoted %d waitlisted reservations after purging user %d", promoted, user.ID)
+	}
+	return res, nil
+}
+
+// purgeLivestreamsContent は配信に紐づくものを消す。配信そのものは消さない
+func purgeLivestreamsContent(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64, del func(table, query string, args ...interface{}) error) error {
+	if len(livestreamIDs) == 0 {
+		return nil
+	}
+	for _, table := range []string{"livestream_tags", "livecomment_reports", "livecomments", "reactions", "ng_words", "livestream_viewers_history", "livestream_viewer_events", "livestream_watch_history", "reservation_idempotency_keys"} {
+		query, params, err := sqlx.In("DELETE FROM "+table+" WHERE livestream_id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if err := del(table, query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
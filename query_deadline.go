@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 重いハンドラのDB処理にかける締め切り (0なら締め切りを設けない)
+var queryDeadline = 5 * time.Second
+
+// queryDeadlineMiddleware はリクエストのコンテキストに締め切りを設ける
+// 予約や検索など負荷が高いときに詰まりやすいハンドラにだけ付けて、裾のレイテンシを抑える
+// ハンドラはc.Request().Context()をDB呼び出しに渡すので、締め切りを過ぎたクエリは中断され、
+// BeginTxxに渡したコンテキストのキャンセルでトランザクションもロールバックされる
+func queryDeadlineMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if queryDeadline <= 0 {
+			return next(c)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), queryDeadline)
+		defer cancel()
+		c.SetRequest(c.Request().WithContext(ctx))
+
+		err := next(c)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// ハンドラ内では500として包まれていることが多いので、締め切りによる失敗であれば503に置き換える
+			c.Response().Header().Set("Retry-After", "1")
+			return newAPIErrorWithInternal(http.StatusServiceUnavailable, "TIMEOUT", "request timed out, please retry later", err)
+		}
+		return err
+	}
+}
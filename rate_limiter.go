@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter はユーザごとのスライディングウィンドウ方式のレートリミッタ
+// limit が0以下の場合は制限しない
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	// userID(int64) -> *rateLimitEntry
+	entries sync.Map
+}
+
+type rateLimitEntry struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+	}
+}
+
+// allow はユーザのリクエストを許可するかを返す
+// 許可しない場合は、次に許可されるまでの待ち時間も返す
+func (l *rateLimiter) allow(userID int64, now time.Time) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+
+	v, _ := l.entries.LoadOrStore(userID, &rateLimitEntry{})
+	entry := v.(*rateLimitEntry)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.prune(now.Add(-l.window))
+	if len(entry.times) >= l.limit {
+		return false, entry.times[0].Add(l.window).Sub(now)
+	}
+	entry.times = append(entry.times, now)
+	return true, 0
+}
+
+// sweep はウィンドウ内にリクエストのないユーザのエントリを削除する
+func (l *rateLimiter) sweep(now time.Time) {
+	l.entries.Range(func(key, value any) bool {
+		entry := value.(*rateLimitEntry)
+		entry.mu.Lock()
+		entry.prune(now.Add(-l.window))
+		idle := len(entry.times) == 0
+		entry.mu.Unlock()
+		if idle {
+			l.entries.Delete(key)
+		}
+		return true
+	})
+}
+
+// runSweeper はウィンドウごとにsweepを実行し続ける
+func (l *rateLimiter) runSweeper() {
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.sweep(now)
+	}
+}
+
+// prune はthreshold以前の記録を捨てる。呼び出し側でロックを取ること
+func (e *rateLimitEntry) prune(threshold time.Time) {
+	i := 0
+	for i < len(e.times) && !e.times[i].After(threshold) {
+		i++
+	}
+	e.times = e.times[i:]
+}
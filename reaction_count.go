@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type ReconcileReactionCountsResponse struct {
+	FixedLivestreams int64 `json:"fixed_livestreams"`
+}
+
+// adjustReactionsCount は配信のリアクション数カウンタをdeltaだけ増減する
+// リアクションのINSERT/DELETEと同じトランザクションで呼び、失敗時は一緒にロールバックされるようにする
+// 同時に投稿されても更新が失われないよう、読み出した値ではなくSQLの中で増減する
+func adjustReactionsCount(ctx context.Context, tx *sqlx.Tx, livestreamID, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET reactions_count = GREATEST(reactions_count + ?, 0) WHERE id = ?", delta, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream reactions count: "+err.Error())
+	}
+	return nil
+}
+
+// reconcileReactionCounts はリアクション数カウンタをreactionsの件数に合わせ直し、直した配信数を返す
+func reconcileReactionCounts(ctx context.Context) (int64, error) {
+	query := `
+	UPDATE livestreams
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS count
+		FROM reactions
+		GROUP BY livestream_id
+	) AS r ON r.livestream_id = livestreams.id
+	SET livestreams.reactions_count = COALESCE(r.count, 0)
+	WHERE livestreams.reactions_count <> COALESCE(r.count, 0)
+	`
+	rs, err := dbConn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+// リアクション数カウンタの整合性修正API (管理者用)
+// POST /api/admin/reconcile-reactions
+// カウンタがreactionsの件数とずれている配信を直し、直した配信数を返す
+func reconcileReactionCountsHandler(c echo.Context) error {
+	fixed, err := reconcileReactionCounts(c.Request().Context())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile reaction counts: "+err.Error())
+	}
+	if fixed > 0 {
+		c.Logger().Warnf("fixed reaction counts of %d livestreams", fixed)
+	}
+	return c.JSON(http.StatusOK, ReconcileReactionCountsResponse{FixedLivestreams: fixed})
+}
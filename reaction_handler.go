@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -33,6 +35,11 @@ type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
 }
 
+type ReactionSummary struct {
+	EmojiName string `db:"emoji_name" json:"emoji_name"`
+	Count     int64  `db:"count" json:"count"`
+}
+
 func getReactionsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -43,10 +50,10 @@ func getReactionsHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -56,7 +63,7 @@ func getReactionsHandler(c echo.Context) error {
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be integer")
 		}
 		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
@@ -87,7 +94,7 @@ func postReactionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 
 	if err := verifyUserSession(c); err != nil {
@@ -102,7 +109,7 @@ func postReactionHandler(c echo.Context) error {
 
 	var req *PostReactionRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -129,6 +136,10 @@ func postReactionHandler(c echo.Context) error {
 	}
 	reactionModel.ID = reactionID
 
+	if err := adjustReactionsCount(ctx, tx, reactionModel.LivestreamID, 1); err != nil {
+		return err
+	}
+
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
@@ -141,6 +152,56 @@ func postReactionHandler(c echo.Context) error {
 	return c.JSON(http.StatusCreated, reaction)
 }
 
+// リアクション内訳API
+// GET /api/livestream/:livestream_id/reactions/summary
+// 配信者向けに、絵文字ごとのリアクション数を多い順に返す
+// 順序を保つため、絵文字名をキーにしたオブジェクトではなく配列で返す
+func getReactionSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var ownerID int64
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if ownerID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't get other streamer's reaction summary")
+	}
+
+	summaries := []ReactionSummary{}
+	if err := tx.SelectContext(ctx, &summaries, "SELECT emoji_name, COUNT(*) AS count FROM reactions WHERE livestream_id = ? GROUP BY emoji_name ORDER BY count DESC, emoji_name ASC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, summaries)
+}
+
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
 	userModel := UserModel{}
 	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// 受け付けるX-Request-IDの最大長。これより長いものは使わずに採番し直す
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// requestIDFromContext はリクエストに割り当てたIDを返す。リクエスト外ではfalse
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDContextKey{}).(string)
+	return id, ok
+}
+
+// requestIDMiddleware はリクエストごとにIDを割り当てる
+// クライアントがX-Request-IDを送ってきた場合はそれを使い、なければ採番する
+// IDはレスポンスヘッダとコンテキストに入れ、c.Logger()のログにも付くようにする
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.NewString()
+		}
+
+		c.Response().Header().Set(requestIDHeader, id)
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, id)))
+		c.SetLogger(&requestIDLogger{Logger: c.Logger(), prefix: fmt.Sprintf("request_id=%s ", id)})
+		return next(c)
+	}
+}
+
+// requestIDLogger はメッセージの先頭にrequest_id=...を付けるロガー
+// ヘッダ部分 (JSON) は元のロガーのままなので、ログの形式は変わらない
+type requestIDLogger struct {
+	echo.Logger
+	prefix string
+}
+
+func (l *requestIDLogger) Print(i ...interface{}) { l.Logger.Print(l.prefix + fmt.Sprint(i...)) }
+func (l *requestIDLogger) Debug(i ...interface{}) { l.Logger.Debug(l.prefix + fmt.Sprint(i...)) }
+func (l *requestIDLogger) Info(i ...interface{})  { l.Logger.Info(l.prefix + fmt.Sprint(i...)) }
+func (l *requestIDLogger) Warn(i ...interface{})  { l.Logger.Warn(l.prefix + fmt.Sprint(i...)) }
+func (l *requestIDLogger) Error(i ...interface{}) { l.Logger.Error(l.prefix + fmt.Sprint(i...)) }
+func (l *requestIDLogger) Fatal(i ...interface{}) { l.Logger.Fatal(l.prefix + fmt.Sprint(i...)) }
+func (l *requestIDLogger) Panic(i ...interface{}) { l.Logger.Panic(l.prefix + fmt.Sprint(i...)) }
+
+// prefixed はprefixを書式の引数として先頭に加える
+// IDはクライアントが送ってきた値なので、書式文字列には含めない
+func (l *requestIDLogger) prefixed(args []interface{}) []interface{} {
+	return append([]interface{}{l.prefix}, args...)
+}
+
+func (l *requestIDLogger) Printf(format string, args ...interface{}) {
+	l.Logger.Printf("%s"+format, l.prefixed(args)...)
+}
+func (l *requestIDLogger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debugf("%s"+format, l.prefixed(args)...)
+}
+func (l *requestIDLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infof("%s"+format, l.prefixed(args)...)
+}
+func (l *requestIDLogger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warnf("%s"+format, l.prefixed(args)...)
+}
+func (l *requestIDLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf("%s"+format, l.prefixed(args)...)
+}
+func (l *requestIDLogger) Fatalf(format string, args ...interface{}) {
+	l.Logger.Fatalf("%s"+format, l.prefixed(args)...)
+}
+func (l *requestIDLogger) Panicf(format string, args ...interface{}) {
+	l.Logger.Panicf("%s"+format, l.prefixed(args)...)
+}
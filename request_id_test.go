@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequestIDLoggerDoesNotFormatClientID(t *testing.T) {
+	e := echo.New()
+	var buf bytes.Buffer
+	e.Logger.SetOutput(&buf)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestIDHeader, "%d%s%%")
+	c := e.NewContext(req, httptest.NewRecorder())
+	err := requestIDMiddleware(func(c echo.Context) error {
+		c.Logger().Errorf("failed at %s: %d", "step", 42)
+		return nil
+	})(c)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "request_id=%d%s%% failed at step: 42") {
+		t.Errorf("log = %q, want the request id kept verbatim", out)
+	}
+	if strings.Contains(out, "%!") {
+		t.Errorf("log = %q, contains a formatting error", out)
+	}
+}
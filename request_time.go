@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type requestTimeContextKey struct{}
+
+// requestTimeMiddleware はリクエストを受け付けた時刻をコンテキストに入れる
+// 1つのレスポンスの中で配信の状態などを同じ時刻で判定するために使う
+func requestTimeMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestTimeContextKey{}, time.Now())))
+		return next(c)
+	}
+}
+
+// requestTime はリクエストを受け付けた時刻を返す。リクエスト外では現在時刻を返す
+func requestTime(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(requestTimeContextKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
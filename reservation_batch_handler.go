@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 一度にまとめて予約できる配信数 (毎週の番組1年分)
+const maxReservationBatchSize = 52
+
+type ReservationBatchItemError struct {
+	// Index はリクエストの配列での位置 (0始まり)
+	Index int `json:"index"`
+	ErrorDetail
+}
+
+type ReservationBatchErrorResponse struct {
+	Error ErrorDetail                 `json:"error"`
+	Items []ReservationBatchItemError `json:"items"`
+}
+
+// reservationBatchItemError はまとめて予約するうちの1件の失敗を表す
+type reservationBatchItemError struct {
+	index int
+	err   *echo.HTTPError
+}
+
+func (e *reservationBatchItemError) Error() string {
+	return fmt.Sprintf("reservation %d: %v", e.index, e.err)
+}
+
+// Unwrap はデッドロックの判定などで元のエラーを辿れるようにする
+func (e *reservationBatchItemError) Unwrap() error {
+	return e.err
+}
+
+// 配信一括予約API
+// POST /api/livestream/reserve/batch
+// 予約リクエストの配列を受け取り、1つのトランザクションですべて予約する。1件でも予約できなければ何も予約しない
+// レートリミットでは1回の予約として数える
+func reserveLivestreamBatchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if ok, retryAfter := reservationRateLimiter.allow(userID, time.Now()); !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return newAPIError(http.StatusTooManyRequests, "RATE_LIMITED", "too many reservations")
+	}
+
+	loc, err := parseReservationTimezone(c)
+	if err != nil {
+		return err
+	}
+
+	var reqs []*ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&reqs); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if len(reqs) == 0 {
+		return newAPIError(http.StatusBadRequest, "BATCH_EMPTY", "at least one reservation is required")
+	}
+	if len(reqs) > maxReservationBatchSize {
+		return newAPIError(http.StatusBadRequest, "BATCH_TOO_LARGE", fmt.Sprintf("at most %d reservations can be made at once", maxReservationBatchSize))
+	}
+
+	// DBを触らずに確かめられるものは、全件分の誤りをまとめて返す
+	var itemErrors []ReservationBatchItemError
+	for i, req := range reqs {
+		if err := validateReservationBatchItem(req, loc); err != nil {
+			_, detail := newErrorDetail(err)
+			itemErrors = append(itemErrors, ReservationBatchItemError{Index: i, ErrorDetail: detail})
+		}
+	}
+	if len(itemErrors) > 0 {
+		return c.JSON(http.StatusBadRequest, ReservationBatchErrorResponse{
+			Error: ErrorDetail{Code: "INVALID_RESERVATIONS", Message: "some reservations are invalid"},
+			Items: itemErrors,
+		})
+	}
+
+	var livestreams []Livestream
+	err = retryOnLockConflict(ctx, c.Logger(), func() error {
+		var err error
+		livestreams, err = reserveLivestreamBatch(ctx, c.Logger(), userID, reqs)
+		return err
+	})
+	if err != nil {
+		var itemErr *reservationBatchItemError
+		if errors.As(err, &itemErr) && itemErr.err.Code < http.StatusInternalServerError {
+			status, detail := newErrorDetail(itemErr.err)
+			return c.JSON(status, ReservationBatchErrorResponse{
+				Error: ErrorDetail{Code: "RESERVATION_FAILED", Message: "failed to reserve livestreams"},
+				Items: []ReservationBatchItemError{{Index: itemErr.index, ErrorDetail: detail}},
+			})
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, livestreams)
+}
+
+// validateReservationBatchItem は予約リクエスト1件をreserveLivestreamHandlerと同じように検証する
+func validateReservationBatchItem(req *ReserveLivestreamRequest, loc *time.Location) error {
+	if req == nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "reservation must be an object")
+	}
+	if req.Waitlist {
+		return newAPIError(http.StatusBadRequest, "WAITLIST_UNSUPPORTED", "waitlist is not supported in batch reservations")
+	}
+	if err := validateLivestreamText(req.Title, req.Description); err != nil {
+		return err
+	}
+	if err := normalizeReservationURLs(req); err != nil {
+		return err
+	}
+	if err := validateReservationDuration(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+	return validateReservationTerm(req.StartAt, req.EndAt, loc)
+}
+
+// reserveLivestreamBatch は1回分のトランザクションでreqsをすべて予約し、reqsと同じ順で配信を返す
+func reserveLivestreamBatch(ctx context.Context, logger echo.Logger, userID int64, reqs []*ReserveLivestreamRequest) ([]Livestream, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 単体の予約と同じく開始時刻の早い予約枠からロックを取るよう、開始時刻順に予約する
+	order := make([]int, len(reqs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return reqs[order[i]].StartAt < reqs[order[j]].StartAt })
+
+	now := time.Now()
+	livestreams := make([]Livestream, len(reqs))
+	for _, i := range order {
+		req := reqs[i]
+		itemError := func(err error) error {
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				return &reservationBatchItemError{index: i, err: he}
+			}
+			return err
+		}
+
+		tagIDs, err := validateTagIDs(ctx, tx, req.Tags)
+		if err != nil {
+			return nil, itemError(err)
+		}
+		if err := reserveSlots(ctx, logger, tx, req.StartAt, req.EndAt); err != nil {
+			return nil, itemError(err)
+		}
+
+		livestreamModel := &LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      req.StartAt,
+			EndAt:        req.EndAt,
+			CreatedAt:    now.Unix(),
+		}
+		if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+			return nil, err
+		}
+
+		livestreams[i], err = fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error()).SetInternal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+	}
+
+	return livestreams, nil
+}
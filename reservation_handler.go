@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 仮押さえの有効期間
+	reservationHoldTTL = 5 * time.Minute
+	// 期限切れの仮押さえを解放する間隔
+	reservationHoldExpireInterval = 30 * time.Second
+)
+
+type ReservationHoldModel struct {
+	ID        int64  `db:"id"`
+	Token     string `db:"token"`
+	UserID    int64  `db:"user_id"`
+	StartAt   int64  `db:"start_at"`
+	EndAt     int64  `db:"end_at"`
+	ExpiresAt int64  `db:"expires_at"`
+}
+
+type HoldReservationRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+type ReservationHold struct {
+	Token     string `json:"token"`
+	StartAt   int64  `json:"start_at"`
+	EndAt     int64  `json:"end_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// 予約枠仮押さえAPI
+// POST /api/livestream/reservation/hold
+// 予約枠を減らしてトークンを返す。期限内にconfirmされなければ予約枠は戻される
+func holdReservationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if ok, retryAfter := reservationRateLimiter.allow(userID, time.Now()); !ok {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return newAPIError(http.StatusTooManyRequests, "RATE_LIMITED", "too many reservations")
+	}
+
+	loc, err := parseReservationTimezone(c)
+	if err != nil {
+		return err
+	}
+
+	var req *HoldReservationRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if err := validateReservationDuration(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	if err := validateReservationTerm(req.StartAt, req.EndAt, loc); err != nil {
+		return err
+	}
+
+	// 期限切れの仮押さえの解放とはロックを取る順番が逆でデッドロックしうるので、トランザクションごとやり直す
+	var holdModel ReservationHoldModel
+	err = retryOnLockConflict(ctx, c.Logger(), func() error {
+		var err error
+		holdModel, err = holdReservation(ctx, c.Logger(), userID, req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, ReservationHold{
+		Token:     holdModel.Token,
+		StartAt:   holdModel.StartAt,
+		EndAt:     holdModel.EndAt,
+		ExpiresAt: holdModel.ExpiresAt,
+	})
+}
+
+// holdReservation は1回分のトランザクションで予約枠を仮押さえする
+// デッドロック時にやり直せるよう、トランザクションの開始からコミットまでをここで完結させる
+func holdReservation(ctx context.Context, logger echo.Logger, userID int64, req *HoldReservationRequest) (ReservationHoldModel, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return ReservationHoldModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := reserveSlots(ctx, logger, tx, req.StartAt, req.EndAt); err != nil {
+		return ReservationHoldModel{}, err
+	}
+
+	holdModel := ReservationHoldModel{
+		Token:     uuid.NewString(),
+		UserID:    userID,
+		StartAt:   req.StartAt,
+		EndAt:     req.EndAt,
+		ExpiresAt: time.Now().Add(reservationHoldTTL).Unix(),
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_holds (token, user_id, start_at, end_at, expires_at) VALUES (:token, :user_id, :start_at, :end_at, :expires_at)", holdModel); err != nil {
+		return ReservationHoldModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation hold: "+err.Error()).SetInternal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ReservationHoldModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error()).SetInternal(err)
+	}
+
+	return holdModel, nil
+}
+
+// 仮押さえ確定API
+// POST /api/livestream/reservation/hold/:token/confirm
+// 仮押さえした予約枠で配信を作成する。予約区間は仮押さえのものを使う
+func confirmReservationHoldHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if err := validateLivestreamText(req.Title, req.Description); err != nil {
+		return err
+	}
+	if err := normalizeReservationURLs(req); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var holdModel ReservationHoldModel
+	if err := tx.GetContext(ctx, &holdModel, "SELECT * FROM reservation_holds WHERE token = ? FOR UPDATE", c.Param("token")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "HOLD_NOT_FOUND", "not found reservation hold")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation hold: "+err.Error())
+	}
+	if holdModel.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't confirm other user's reservation hold")
+	}
+	if holdModel.ExpiresAt <= time.Now().Unix() {
+		return newAPIError(http.StatusGone, "HOLD_EXPIRED", "reservation hold has expired")
+	}
+
+	tagIDs, err := validateTagIDs(ctx, tx, req.Tags)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_holds WHERE id = ?", holdModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reservation hold: "+err.Error())
+	}
+
+	livestreamModel := &LivestreamModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      holdModel.StartAt,
+		EndAt:        holdModel.EndAt,
+		CreatedAt:    time.Now().Unix(),
+	}
+	if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// expireReservationHolds は期限切れの仮押さえを削除し、予約枠を戻す
+// 仮押さえの削除に成功した場合のみ予約枠を戻すので、同じ仮押さえに対して何度実行しても二重に戻ることはない
+// 戻した予約枠でキャンセル待ちを繰り上げる
+func expireReservationHolds(ctx context.Context, logger echo.Logger, now time.Time) (int, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var holdModels []*ReservationHoldModel
+	if err := tx.SelectContext(ctx, &holdModels, "SELECT * FROM reservation_holds WHERE expires_at <= ? FOR UPDATE", now.Unix()); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, holdModel := range holdModels {
+		rs, err := tx.ExecContext(ctx, "DELETE FROM reservation_holds WHERE id = ?", holdModel.ID)
+		if err != nil {
+			return 0, err
+		}
+		deleted, err := rs.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if deleted == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", holdModel.StartAt, holdModel.EndAt); err != nil {
+			return 0, err
+		}
+		if _, err := promoteWaitlist(ctx, logger, tx, holdModel.StartAt, holdModel.EndAt); err != nil {
+			return 0, err
+		}
+		expired++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+// runReservationHoldExpirer は定期的に期限切れの仮押さえを解放し続ける
+func runReservationHoldExpirer(logger echo.Logger) {
+	ticker := time.NewTicker(reservationHoldExpireInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired, err := expireReservationHolds(context.Background(), logger, now)
+		if err != nil {
+			logger.Warnf("failed to expire reservation holds: %+v", err)
+			continue
+		}
+		if expired > 0 {
+			logger.Infof("expired %d reservation holds", expired)
+		}
+
+		// 期限切れの予約の冪等キーもついでに掃除する
+		purged, err := purgeExpiredIdempotencyKeys(context.Background(), now)
+		if err != nil {
+			logger.Warnf("failed to purge idempotency keys: %+v", err)
+			continue
+		}
+		if purged > 0 {
+			logger.Infof("purged %d idempotency keys", purged)
+		}
+	}
+}
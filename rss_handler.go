@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+}
+
+// 配信一覧RSS API
+// GET /api/user/:username/livestreams.rss
+// フィードリーダーから購読できるよう、ユーザの配信をRSS 2.0で返す。セッションは不要
+// タイトル等のエスケープはencoding/xmlに任せる
+func getUserLivestreamsRSSHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	user, err := getUserByName(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? ORDER BY start_at DESC, id DESC", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	doc := rssDocument{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       user.DisplayName + " の配信",
+			Link:        "https://" + user.Name + ".u.isucon.dev/",
+			Description: user.Description,
+			Items:       make([]rssItem, len(livestreamModels)),
+		},
+	}
+	for i, livestreamModel := range livestreamModels {
+		doc.Channel.Items[i] = rssItem{
+			Title:       livestreamModel.Title,
+			Description: livestreamModel.Description,
+			Link:        livestreamModel.PlaylistUrl,
+			GUID:        livestreamModel.PlaylistUrl,
+			PubDate:     time.Unix(livestreamModel.StartAt, 0).UTC().Format(time.RFC1123Z),
+		}
+	}
+
+	body, err := xml.Marshal(doc)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode rss: "+err.Error())
+	}
+	return c.Blob(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/singleflight"
+)
+
+// 検索結果キャッシュに保持する最大件数
+const maxSearchCacheEntries = 1024
+
+// searchResult は配信検索の結果。light=1 ならlightLivestreamsの方を使う
+// キャッシュから複数のリクエストに同じものを返すので、取り出した後に書き換えてはいけない
+type searchResult struct {
+	livestreams      []Livestream
+	lightLivestreams []LightLivestream
+}
+
+type searchCacheEntry struct {
+	result    searchResult
+	expiresAt time.Time
+}
+
+// searchResultCache は配信検索の結果を短い時間だけ保持する
+// キーには検索のETag (DBの状態から作る) を使うので、配信の予約や編集があれば自然に別のキーになる
+// ETagで検出できない変化も、古い結果を返すのはTTLの間だけに限られる
+type searchResultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]searchCacheEntry
+	// 期限切れ直後に同じ検索が集中しても、DBに問い合わせるのは1つだけにする
+	group singleflight.Group
+}
+
+func newSearchResultCache(ttl time.Duration) *searchResultCache {
+	return &searchResultCache{
+		ttl:     ttl,
+		entries: make(map[string]searchCacheEntry),
+	}
+}
+
+// searchCache はTTLが0以下ならキャッシュしない
+var searchCache = newSearchResultCache(time.Second)
+
+func (sc *searchResultCache) get(key string, now time.Time) (searchResult, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	entry, ok := sc.entries[key]
+	if !ok || !now.Before(entry.expiresAt) {
+		return searchResult{}, false
+	}
+	return entry.result, true
+}
+
+func (sc *searchResultCache) set(key string, result searchResult, now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if len(sc.entries) >= maxSearchCacheEntries {
+		for k, entry := range sc.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(sc.entries, k)
+			}
+		}
+	}
+	// 期限内のものだけで埋まっている場合は、どれか1つを捨てる
+	for k := range sc.entries {
+		if len(sc.entries) < maxSearchCacheEntries {
+			break
+		}
+		delete(sc.entries, k)
+	}
+	sc.entries[key] = searchCacheEntry{result: result, expiresAt: now.Add(sc.ttl)}
+}
+
+// do はキャッシュがあればそれを返し、なければfetchで取得してキャッシュする
+// 同じキーのfetchが実行中なら、その結果を待って共有する。待つのはctxが終わるまで
+// fetchは呼び出し元のトランザクションではなく、runSharedReadOnlyの専用トランザクションで実行する
+func (sc *searchResultCache) do(ctx context.Context, key string, fetch func(ctx context.Context, tx *sqlx.Tx) (searchResult, error)) (searchResult, error) {
+	if sc.ttl <= 0 {
+		return sc.fetch(ctx, fetch)
+	}
+	if result, ok := sc.get(key, time.Now()); ok {
+		return result, nil
+	}
+
+	ch := sc.group.DoChan(key, func() (interface{}, error) {
+		// 待っている間に他のリクエストがキャッシュしたかもしれない
+		if result, ok := sc.get(key, time.Now()); ok {
+			return result, nil
+		}
+		result, err := sc.fetch(ctx, fetch)
+		if err != nil {
+			return searchResult{}, err
+		}
+		sc.set(key, result, time.Now())
+		return result, nil
+	})
+	v, err := waitShared(ctx, ch)
+	if err != nil {
+		return searchResult{}, err
+	}
+	return v.(searchResult), nil
+}
+
+func (sc *searchResultCache) fetch(ctx context.Context, fetch func(ctx context.Context, tx *sqlx.Tx) (searchResult, error)) (searchResult, error) {
+	var result searchResult
+	err := runSharedReadOnly(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		result, err = fetch(ctx, tx)
+		return err
+	})
+	return result, err
+}
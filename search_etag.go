@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// touchLivestream は配信の行を書き換えずに検索結果が変わる操作 (コメントの投稿・削除、タグの削除) で、updated_atを進める
+// 配信の行を更新する操作はON UPDATEでupdated_atが進むので呼ばなくてよい
+func touchLivestream(ctx context.Context, tx *sqlx.Tx, livestreamID int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET updated_at = CURRENT_TIMESTAMP(6) WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to touch livestream: "+err.Error()).SetInternal(err)
+	}
+	return nil
+}
+
+// recordDeletedLivestreams は削除する配信をdeleted_livestreamsに記録する。配信を消す前に呼ぶこと
+// 削除は最大IDやupdated_atに現れないので、検索のETagはこの記録で削除を検出する
+func recordDeletedLivestreams(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64, deletedAt int64) error {
+	if len(livestreamIDs) == 0 {
+		return nil
+	}
+	query, params, err := sqlx.In("INSERT INTO deleted_livestreams (livestream_id, deleted_at) SELECT id, ? FROM livestreams WHERE id IN (?)", deletedAt, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error()).SetInternal(err)
+	}
+	if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to record deleted livestreams: "+err.Error()).SetInternal(err)
+	}
+	return nil
+}
+
+// searchETag はDBの状態とクエリパラメータから検索結果の弱いETagを作る
+// 配信の追加は最大ID、更新はupdated_atの最大値、削除はdeleted_livestreamsの最大ID、タグの別名の追加はtag_aliasesの最大IDで検出する
+// いずれもインデックスの端を見るだけなので、中身を組み立てなくても安く比較できる
+// 同時に更新したトランザクションのコミット順によってはupdated_atの最大値が変わらないことがあるが、次の更新で追いつく
+// 配信の状態(state)は時間が経つだけで変わるので、次に開始・終了を迎える時刻も含める
+// 開始・終了を迎えるたびにこれらが先へ進むので、境界をまたいだ時点で別のETagになる
+func searchETag(c echo.Context, tx *sqlx.Tx) (string, error) {
+	ctx := c.Request().Context()
+	now := requestTime(ctx).Unix()
+	var stats struct {
+		MaxID        int64 `db:"max_id"`
+		UpdatedAt    int64 `db:"updated_at"`
+		MaxDeletedID int64 `db:"max_deleted_id"`
+		MaxAliasID   int64 `db:"max_alias_id"`
+		NextStartAt  int64 `db:"next_start_at"`
+		NextEndAt    int64 `db:"next_end_at"`
+	}
+	query := `
+	SELECT
+		(SELECT COALESCE(MAX(id), 0) FROM livestreams) AS max_id,
+		(SELECT COALESCE(CAST(UNIX_TIMESTAMP(MAX(updated_at)) * 1000000 AS SIGNED), 0) FROM livestreams) AS updated_at,
+		(SELECT COALESCE(MAX(id), 0) FROM deleted_livestreams) AS max_deleted_id,
+		(SELECT COALESCE(MAX(id), 0) FROM tag_aliases) AS max_alias_id,
+		(SELECT COALESCE(MIN(start_at), 0) FROM livestreams WHERE start_at > ?) AS next_start_at,
+		(SELECT COALESCE(MIN(end_at), 0) FROM livestreams WHERE end_at > ?) AS next_end_at
+	`
+	if err := tx.GetContext(ctx, &stats, query, now, now); err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	// Encodeはキー順に並べるので、パラメータの順序が違っても同じ値になる
+	h.Write([]byte(c.QueryParams().Encode()))
+
+	return fmt.Sprintf(`W/"%d-%d-%d-%d-%d-%d-%x"`, stats.MaxID, stats.UpdatedAt, stats.MaxDeletedID, stats.MaxAliasID, stats.NextStartAt, stats.NextEndAt, h.Sum64()), nil
+}
+
+// etagMatches はIf-None-Matchのいずれかがetagと弱い比較で一致するか調べる
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSearchETag はETagヘッダを付け、クライアントのキャッシュが最新なら304を返したことをtrueで伝える
+func checkSearchETag(c echo.Context, tx *sqlx.Tx) (string, bool, error) {
+	etag, err := searchETag(c, tx)
+	if err != nil {
+		return "", false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get search etag: "+err.Error())
+	}
+	c.Response().Header().Set("ETag", etag)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return etag, true, c.NoContent(http.StatusNotModified)
+	}
+	return etag, false, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `W/"1-2-3-4-5-6-abc"`
+	for _, tt := range []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{ifNoneMatch: "", want: false},
+		{ifNoneMatch: `W/"1-2-3-4-5-6-abc"`, want: true},
+		{ifNoneMatch: `"1-2-3-4-5-6-abc"`, want: true},
+		{ifNoneMatch: `"other", W/"1-2-3-4-5-6-abc"`, want: true},
+		{ifNoneMatch: `W/"1-2-3-4-5-7-abc"`, want: false},
+		{ifNoneMatch: "*", want: true},
+	} {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
+
+// currentSearchETag はクエリパラメータなしの検索のETagを返す
+func currentSearchETag(t *testing.T) string {
+	t.Helper()
+	return searchETagAt(t, time.Now())
+}
+
+// searchETagAt はnowに受け付けたリクエストとして、クエリパラメータなしの検索のETagを返す
+func searchETagAt(t *testing.T, now time.Time) string {
+	t.Helper()
+
+	c, _ := newTestContext(t, http.MethodGet, "/api/livestream/search", nil, 0)
+	req := c.Request()
+	c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestTimeContextKey{}, now)))
+	tx, err := beginReadOnlyTx(context.Background())
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %+v", err)
+	}
+	defer tx.Rollback()
+	etag, err := searchETag(c, tx)
+	if err != nil {
+		t.Fatalf("failed to get search etag: %+v", err)
+	}
+	return etag
+}
+
+func TestSearchETagChangesWithDBState(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	baseAt := reservationTermStartAt.Unix()
+	livestreamID := insertTestLivestream(t, userID, "live", baseAt, baseAt+3600)
+	otherID := insertTestLivestream(t, userID, "other", baseAt, baseAt+3600)
+
+	for _, step := range []struct {
+		name   string
+		change func(ctx context.Context) error
+	}{
+		{name: "update a livestream row", change: func(ctx context.Context) error {
+			_, err := dbConn.ExecContext(ctx, "UPDATE livestreams SET reactions_count = reactions_count + 1 WHERE id = ?", livestreamID)
+			return err
+		}},
+		{name: "touch a livestream", change: func(ctx context.Context) error {
+			tx, err := dbConn.BeginTxx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := touchLivestream(ctx, tx, livestreamID); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}},
+		{name: "delete a livestream that is not the latest", change: func(ctx context.Context) error {
+			tx, err := dbConn.BeginTxx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := recordDeletedLivestreams(ctx, tx, []int64{livestreamID}, baseAt); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM livestreams WHERE id = ?", livestreamID); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}},
+		{name: "add a tag alias", change: func(ctx context.Context) error {
+			_, err := dbConn.ExecContext(ctx, "INSERT INTO tag_aliases (alias, tag_id) VALUES ('alias', ?)", otherID)
+			return err
+		}},
+	} {
+		before := currentSearchETag(t)
+		if err := step.change(context.Background()); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+		if after := currentSearchETag(t); after == before {
+			t.Errorf("%s: etag did not change (%s)", step.name, before)
+		}
+	}
+}
+
+func TestSearchETagChangesWhenLivestreamStartsOrEnds(t *testing.T) {
+	setupTestDB(t)
+
+	userID := insertTestUser(t, "streamer")
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + 3600
+	insertTestLivestream(t, userID, "live", startAt, endAt)
+
+	at := func(unix int64) string { return searchETagAt(t, time.Unix(unix, 0)) }
+	for _, tt := range []struct {
+		name      string
+		from, to  int64
+		wantEqual bool
+	}{
+		{name: "before start", from: startAt - 120, to: startAt - 60, wantEqual: true},
+		{name: "across start", from: startAt - 1, to: startAt, wantEqual: false},
+		{name: "while live", from: startAt + 60, to: endAt - 60, wantEqual: true},
+		{name: "across end", from: endAt - 1, to: endAt, wantEqual: false},
+		{name: "after end", from: endAt + 60, to: endAt + 120, wantEqual: true},
+	} {
+		if got := at(tt.from) == at(tt.to); got != tt.wantEqual {
+			t.Errorf("%s: etag equal = %v, want %v", tt.name, got, tt.wantEqual)
+		}
+	}
+}
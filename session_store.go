@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// セッションの保存先。cookie (デフォルト) か redis
+	sessionBackendEnvKey = "ISUCON13_SESSION_BACKEND"
+	// redisを使う場合の接続先 (redis://[:password@]host:port[/db])
+	sessionRedisURLEnvKey = "ISUCON13_SESSION_REDIS_URL"
+
+	// redisのキーの接頭辞
+	redisSessionKeyPrefix = "isupipe:session:"
+	// MaxAge未指定 (ブラウザを閉じるまで) のセッションをredisに残しておく期間
+	redisSessionDefaultTTL = 24 * time.Hour
+	// redisへの1コマンドあたりのタイムアウト
+	redisCommandTimeout = time.Second
+	// 使い回すために残しておくredisへの接続数
+	redisMaxIdleConns = 16
+)
+
+// newSessionStore は環境変数で選んだセッションの保存先を返す
+// redisの場合は起動時に接続を確かめ、繋がらなければエラーを返す
+func newSessionStore() (sessions.Store, error) {
+	switch backend := os.Getenv(sessionBackendEnvKey); backend {
+	case "", "cookie":
+		cookieStore := sessions.NewCookieStore(secret)
+		cookieStore.Options.Domain = "*.u.isucon.dev"
+		return cookieStore, nil
+	case "redis":
+		rawURL, ok := os.LookupEnv(sessionRedisURLEnvKey)
+		if !ok {
+			return nil, fmt.Errorf("environ %s must be provided when %s=redis", sessionRedisURLEnvKey, sessionBackendEnvKey)
+		}
+		client, err := newRedisClient(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := client.do(ctx, "PING"); err != nil {
+			return nil, fmt.Errorf("failed to connect to redis at %s: %w", client.addr, err)
+		}
+		store := newRedisStore(client, secret)
+		store.Options.Domain = "*.u.isucon.dev"
+		return store, nil
+	default:
+		return nil, fmt.Errorf("environ %s must be cookie or redis: %q", sessionBackendEnvKey, backend)
+	}
+}
+
+// redisStore はセッションの中身をredisに置くsessions.Store
+// cookieには署名したセッションIDだけを入れるので、同じredisを見ていればどのインスタンスでも読める
+type redisStore struct {
+	client  *redisClient
+	codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newRedisStore(client *redisClient, keyPairs ...[]byte) *redisStore {
+	return &redisStore{
+		client: client,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+func (s *redisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *redisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...); err != nil {
+		return session, err
+	}
+	reply, err := s.client.do(r.Context(), "GET", redisSessionKeyPrefix+session.ID)
+	if err != nil {
+		return session, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		// 期限切れなどでredisから消えている
+		return session, nil
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *redisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.client.do(r.Context(), "DEL", redisSessionKeyPrefix+session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if ttl == 0 {
+		ttl = redisSessionDefaultTTL
+	}
+	if _, err := s.client.do(r.Context(), "SET", redisSessionKeyPrefix+session.ID, string(data), "EX", strconv.FormatInt(int64(ttl/time.Second), 10)); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// redisClient はセッションの読み書きに必要なだけのコマンドを送るredisクライアント
+// 接続は使い終わったらidleに戻して使い回す
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError はredisが返したエラー応答。接続自体は引き続き使える
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url: must be redis://[:password@]host:port[/db]")
+	}
+	client := &redisClient{
+		addr: u.Host,
+		idle: make(chan *redisConn, redisMaxIdleConns),
+	}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		client.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url: db must be integer")
+		}
+	}
+	return client, nil
+}
+
+// do はコマンドを1つ送って応答を返す
+// 応答は文字列 (+), 整数 (:), []byte (バルク文字列), nil (存在しない値) のいずれか
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, reused, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.doOn(ctx, conn, args...)
+	// idleの間にredis側で切られていた接続なら、新しい接続で1度だけやり直す
+	if err != nil && reused && !isRedisError(err) && ctx.Err() == nil {
+		if conn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+		reply, err = c.doOn(ctx, conn, args...)
+	}
+	return reply, err
+}
+
+// doOn はconnでコマンドを送り、使い続けられる接続ならidleに戻す
+func (c *redisClient) doOn(ctx context.Context, conn *redisConn, args ...string) (interface{}, error) {
+	reply, err := conn.do(ctx, args...)
+	if err != nil && !isRedisError(err) {
+		conn.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+	return reply, err
+}
+
+func isRedisError(err error) bool {
+	var redisErr redisError
+	return errors.As(err, &redisErr)
+}
+
+// conn はidleの接続か新しい接続を返す。idleの接続を返した場合はreusedがtrueになる
+func (c *redisClient) conn(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := c.dial(ctx)
+	return conn, false, err
+}
+
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, redisCommandTimeout)
+	defer cancel()
+	nc, err := d.DialContext(dialCtx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := conn.do(ctx, "AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(redisCommandTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply: %q", line)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRedisConnReadReply(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		in      string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "simple string", in: "+OK\r\n", want: "OK"},
+		{name: "integer", in: ":42\r\n", want: int64(42)},
+		{name: "negative integer", in: ":-1\r\n", want: int64(-1)},
+		{name: "bulk string", in: "$5\r\nhello\r\n", want: []byte("hello")},
+		{name: "bulk string with CRLF", in: "$7\r\nfoo\r\nba\r\n", want: []byte("foo\r\nba")},
+		{name: "empty bulk string", in: "$0\r\n\r\n", want: []byte{}},
+		{name: "nil bulk string", in: "$-1\r\n", want: nil},
+		{name: "invalid integer", in: ":abc\r\n", wantErr: true},
+		{name: "invalid bulk length", in: "$abc\r\n", wantErr: true},
+		{name: "truncated bulk string", in: "$5\r\nhel", wantErr: true},
+		{name: "empty line", in: "\r\n", wantErr: true},
+		{name: "unsupported array", in: "*1\r\n$1\r\na\r\n", wantErr: true},
+		{name: "eof", in: "", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &redisConn{r: bufio.NewReader(strings.NewReader(tt.in))}
+			got, err := conn.readReply()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("readReply() = %#v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readReply() returned error: %+v", err)
+			}
+			if b, ok := tt.want.([]byte); ok {
+				if gotBytes, ok := got.([]byte); !ok || !bytes.Equal(gotBytes, b) {
+					t.Errorf("readReply() = %#v, want %#v", got, tt.want)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("readReply() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisConnReadReplyError(t *testing.T) {
+	conn := &redisConn{r: bufio.NewReader(strings.NewReader("-ERR unknown command\r\n+OK\r\n"))}
+	_, err := conn.readReply()
+	var redisErr redisError
+	if !errors.As(err, &redisErr) || string(redisErr) != "ERR unknown command" {
+		t.Fatalf("readReply() error = %v, want redisError", err)
+	}
+	// エラー応答の後も同じ接続で次の応答を読める
+	if got, err := conn.readReply(); err != nil || got != "OK" {
+		t.Errorf("readReply() = %#v, %v, want OK", got, err)
+	}
+}
+
+// serveTestRedis はコマンドを受け取るたびに+OKを返すだけのredisサーバを立てる
+func serveTestRedis(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("failed to listen: %+v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				r := bufio.NewReader(nc)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+					// 引数ごとに長さの行と値の行を読み飛ばす
+					for i := 0; i < n*2; i++ {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+					}
+					if _, err := nc.Write([]byte("+OK\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRedisClientRetriesStaleIdleConn(t *testing.T) {
+	client := &redisClient{
+		addr: serveTestRedis(t),
+		idle: make(chan *redisConn, redisMaxIdleConns),
+	}
+
+	// redis側で切られた接続がidleに残っている状態にする
+	stale, peer := net.Pipe()
+	peer.Close()
+	client.idle <- &redisConn{conn: stale, r: bufio.NewReader(stale)}
+
+	got, err := client.do(context.Background(), "PING")
+	if err != nil {
+		t.Fatalf("do() returned error: %+v", err)
+	}
+	if got != "OK" {
+		t.Errorf("do() = %#v, want OK", got)
+	}
+	// やり直した新しい接続はidleに戻っている
+	if len(client.idle) != 1 {
+		t.Errorf("idle conns = %d, want 1", len(client.idle))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 処理中のリクエスト数。終了時に待ったリクエスト数をログに出すのに使う
+var inFlightRequests atomic.Int64
+
+// inFlightMiddleware は処理中のリクエスト数を数える
+func inFlightMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Add(-1)
+		return next(c)
+	}
+}
+
+// startWithGracefulShutdown はHTTPサーバを起動し、SIGTERM/SIGINTを受けたら新しい接続を受け付けるのをやめて
+// 処理中のリクエストをtimeoutまで待ってから戻る
+// timeoutを過ぎても終わらないリクエストは接続ごと切り、リクエストのコンテキストがキャンセルされることで
+// トランザクションはロールバックされる (各ハンドラのdefer tx.Rollback()もそのまま実行される)
+func startWithGracefulShutdown(e *echo.Echo, addr string, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Start(addr)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	inFlight := inFlightRequests.Load()
+	log.Printf("shutting down: waiting for %d in-flight requests (timeout %s)", inFlight, timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		remaining := inFlightRequests.Load()
+		log.Printf("shutdown timed out: drained %d requests, aborting %d: %+v", inFlight-remaining, remaining, err)
+		if err := e.Close(); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("shutdown complete: drained %d requests", inFlight)
+	}
+
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type AdjustSlotsRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// Delta は各予約枠に加える数。負なら枠を減らす
+	Delta int64 `json:"delta"`
+}
+
+// 予約枠の増減API (管理者用)
+// POST /api/admin/reservation-slots
+// 区間に含まれる予約枠それぞれの残数とinitial_slotをdeltaだけ増減し、更新後の予約枠を返す
+// 区間は予約枠の境界に揃っている必要があり、残数が負になる枠があれば何も変更しない
+func adjustReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *AdjustSlotsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if req.StartAt >= req.EndAt {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", "end_at must be after start_at")
+	}
+	if req.Delta == 0 {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "delta must not be zero")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	// 区間の両端が枠の境界と一致し、途中に欠けた枠がないこと
+	aligned := len(slots) > 0 && slots[0].StartAt == req.StartAt && slots[len(slots)-1].EndAt == req.EndAt
+	for i := 1; aligned && i < len(slots); i++ {
+		aligned = slots[i-1].EndAt == slots[i].StartAt
+	}
+	if !aligned {
+		return newAPIError(http.StatusBadRequest, "INVALID_RANGE", fmt.Sprintf("区間 %d ~ %dが予約枠の境界と一致しません", req.StartAt, req.EndAt))
+	}
+
+	for _, slot := range slots {
+		if slot.Slot+req.Delta < 0 {
+			return newAPIError(http.StatusBadRequest, "SLOT_UNDERFLOW", fmt.Sprintf("予約枠 %d ~ %dの残数 %dを %d減らすことはできません", slot.StartAt, slot.EndAt, slot.Slot, -req.Delta))
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + ?, initial_slot = initial_slot + ? WHERE start_at >= ? AND end_at <= ?", req.Delta, req.Delta, req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slots: "+err.Error())
+	}
+	for _, slot := range slots {
+		slot.Slot += req.Delta
+		slot.InitialSlot += req.Delta
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+type SlotUtilization struct {
+	ID      int64 `json:"id"`
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// InitialSlot は予約が1件もないときの残数
+	InitialSlot int64 `json:"initial_slot"`
+	// Remaining は予約枠の残数
+	Remaining int64 `json:"remaining"`
+	// Utilization は埋まっている割合 (%)。initial_slotが0の枠は0とする
+	Utilization float64 `json:"utilization"`
+}
+
+type SlotUtilizationResponse struct {
+	// Utilization は予約可能期間全体で埋まっている割合 (%)
+	Utilization float64           `json:"utilization"`
+	Slots       []SlotUtilization `json:"slots"`
+}
+
+// slotUtilization は (initial - remaining) / initial を百分率で返す
+func slotUtilization(initial, remaining int64) float64 {
+	if initial <= 0 {
+		return 0
+	}
+	return float64(initial-remaining) / float64(initial) * 100
+}
+
+// 予約枠の利用率API (管理者用)
+// GET /api/admin/reservation-slots/utilization
+// 予約枠ごとの初期値・残数・利用率を、利用率の高い順に返す
+// 初期値には予約枠の投入時の残数に管理者による増減を反映したinitial_slotを使う
+func getReservationSlotUtilizationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var slots []ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots ORDER BY start_at"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	res := SlotUtilizationResponse{
+		Slots: make([]SlotUtilization, len(slots)),
+	}
+	var totalInitial, totalRemaining int64
+	for i, slot := range slots {
+		res.Slots[i] = SlotUtilization{
+			ID:          slot.ID,
+			StartAt:     slot.StartAt,
+			EndAt:       slot.EndAt,
+			InitialSlot: slot.InitialSlot,
+			Remaining:   slot.Slot,
+			Utilization: slotUtilization(slot.InitialSlot, slot.Slot),
+		}
+		totalInitial += slot.InitialSlot
+		totalRemaining += slot.Slot
+	}
+	res.Utilization = slotUtilization(totalInitial, totalRemaining)
+
+	// 同率なら開始時刻の早い順
+	sort.SliceStable(res.Slots, func(i, j int) bool {
+		return res.Slots[i].Utilization > res.Slots[j].Utilization
+	})
+
+	return c.JSON(http.StatusOK, res)
+}
+
+const (
+	defaultLongestLivestreamsLimit = 20
+	maxLongestLivestreamsLimit     = 100
+)
+
+type LongestLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	// DurationSeconds は配信時間 (end_at - start_at) の秒数
+	DurationSeconds int64 `json:"duration_seconds"`
+	// SlotSpan は配信が消費している予約枠の数
+	SlotSpan int64 `json:"slot_span"`
+}
+
+// 長時間配信一覧API (管理者用)
+// GET /api/admin/livestreams/longest
+// 配信時間の長い順、同じならIDの小さい順に返す。予約枠を独占しているユーザを見つけるために使う
+func getLongestLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultLongestLivestreamsLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be positive integer")
+		}
+		if l > maxLongestLivestreamsLimit {
+			l = maxLongestLivestreamsLimit
+		}
+		limit = l
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams ORDER BY end_at - start_at DESC, id ASC LIMIT ?", limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	// 予約時と同じく、配信区間に収まる予約枠を消費したものとして数える
+	slotSpans := make(map[int64]int64, len(livestreamModels))
+	if len(livestreamModels) > 0 {
+		livestreamIDs := make([]int64, len(livestreamModels))
+		for i := range livestreamModels {
+			livestreamIDs[i] = livestreamModels[i].ID
+		}
+		var spans []struct {
+			LivestreamID int64 `db:"livestream_id"`
+			SlotSpan     int64 `db:"slot_span"`
+		}
+		query, params, err := sqlx.In(`
+		SELECT
+			l.id AS livestream_id,
+			COUNT(rs.id) AS slot_span
+		FROM livestreams l
+		LEFT JOIN reservation_slots rs ON rs.start_at >= l.start_at AND rs.end_at <= l.end_at
+		WHERE l.id IN (?)
+		GROUP BY l.id
+		`, livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &spans, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reservation slots: "+err.Error())
+		}
+		for _, span := range spans {
+			slotSpans[span.LivestreamID] = span.SlotSpan
+		}
+	}
+
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	res := make([]LongestLivestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		res[i] = LongestLivestream{
+			Livestream:      livestreams[i],
+			DurationSeconds: livestreamModel.EndAt - livestreamModel.StartAt,
+			SlotSpan:        slotSpans[livestreamModel.ID],
+		}
+	}
+	return c.JSON(http.StatusOK, res)
+}
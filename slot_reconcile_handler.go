@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SlotDiscrepancy struct {
+	SlotID   int64 `json:"slot_id"`
+	StartAt  int64 `json:"start_at"`
+	EndAt    int64 `json:"end_at"`
+	Slot     int64 `json:"slot"`
+	Expected int64 `json:"expected"`
+}
+
+type ReconcileSlotsResponse struct {
+	CheckedSlots  int               `json:"checked_slots"`
+	Discrepancies []SlotDiscrepancy `json:"discrepancies"`
+	Fixed         bool              `json:"fixed"`
+}
+
+// 予約枠の整合性チェックAPI (管理者用)
+// POST /api/admin/reconcile-slots
+// 予約枠の残数を、枠に重なる配信・仮押さえの数から計算し直して食い違いを返す
+// fix=1 の場合は計算し直した値で予約枠を更新する
+func reconcileSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	fix := c.QueryParam("fix") == "1"
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 計算中に予約が入らないよう、すべての予約枠をロックする
+	var slots []ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots ORDER BY start_at FOR UPDATE"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	res := ReconcileSlotsResponse{
+		CheckedSlots:  len(slots),
+		Discrepancies: []SlotDiscrepancy{},
+		Fixed:         fix,
+	}
+	if len(slots) == 0 {
+		if err := tx.Commit(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+
+	// 予約枠を消費しているもの (配信と仮押さえ) の区間
+	var terms []struct {
+		StartAt int64 `db:"start_at"`
+		EndAt   int64 `db:"end_at"`
+	}
+	query := `
+	SELECT start_at, end_at FROM livestreams WHERE end_at > ?
+	UNION ALL
+	SELECT start_at, end_at FROM reservation_holds
+	`
+	if err := tx.SelectContext(ctx, &terms, query, slots[0].StartAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reserved terms: "+err.Error())
+	}
+
+	// 予約時と同じく、区間に完全に含まれる予約枠を1つずつ消費したものとして数える
+	used := make([]int64, len(slots))
+	for _, term := range terms {
+		i := sort.Search(len(slots), func(i int) bool { return slots[i].StartAt >= term.StartAt })
+		for ; i < len(slots) && slots[i].EndAt <= term.EndAt; i++ {
+			used[i]++
+		}
+	}
+
+	for i, slot := range slots {
+		expected := slot.InitialSlot - used[i]
+		if slot.Slot == expected {
+			continue
+		}
+		res.Discrepancies = append(res.Discrepancies, SlotDiscrepancy{
+			SlotID:   slot.ID,
+			StartAt:  slot.StartAt,
+			EndAt:    slot.EndAt,
+			Slot:     slot.Slot,
+			Expected: expected,
+		})
+		if fix {
+			if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = ? WHERE id = ?", expected, slot.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -1,17 +1,117 @@
 use isupipe;
 
 ALTER TABLE icons ADD hash varchar(255) NOT NULL;
+-- 既存のアイコンのハッシュを埋める (アプリの初期化時にも backfillIconHashes で埋める)
+UPDATE icons SET hash = SHA2(image, 256) WHERE hash = '' AND LENGTH(image) > 0;
+ALTER TABLE livestreams ADD created_at bigint NOT NULL DEFAULT 0;
+ALTER TABLE livestreams ADD is_archived tinyint(1) NOT NULL DEFAULT 0;
+ALTER TABLE livestreams ADD owner_name varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE livestreams ADD owner_display_name varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE livestreams ADD owner_icon_hash varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE livestreams ADD version bigint NOT NULL DEFAULT 0;
+ALTER TABLE livestreams ADD current_viewers bigint NOT NULL DEFAULT 0;
+ALTER TABLE livestreams ADD reactions_count bigint NOT NULL DEFAULT 0;
+-- 既存のリアクション数を埋める (アプリの初期化時にも reconcileReactionCounts で合わせ直す)
+UPDATE livestreams l JOIN (SELECT livestream_id, COUNT(*) AS count FROM reactions GROUP BY livestream_id) r ON r.livestream_id = l.id SET l.reactions_count = r.count;
+-- 記録を始める前の最大値はわからないので、現在の視聴者数から始める
+ALTER TABLE livestreams ADD peak_viewers bigint NOT NULL DEFAULT 0;
+UPDATE livestreams SET peak_viewers = current_viewers;
+-- 検索のETag用。行が変わるたびにMySQLが進める
+ALTER TABLE livestreams ADD updated_at datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6);
+ALTER TABLE reservation_slots ADD initial_slot bigint NOT NULL DEFAULT 0;
+-- 初期データの予約枠はすべて5で作られている
+UPDATE reservation_slots SET initial_slot = 5;
+-- 視聴中の行はユーザと配信の組で1行にする。一意キーを張る前に、重複した行は古いものを残して消す
+DELETE h1 FROM livestream_viewers_history h1 JOIN livestream_viewers_history h2 ON h1.user_id = h2.user_id AND h1.livestream_id = h2.livestream_id AND h1.id > h2.id;
+CREATE TABLE IF NOT EXISTS reservation_holds (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  token varchar(255) NOT NULL,
+  user_id bigint NOT NULL,
+  start_at bigint NOT NULL,
+  end_at bigint NOT NULL,
+  expires_at bigint NOT NULL,
+  UNIQUE KEY uniq_token (token),
+  KEY expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+CREATE TABLE IF NOT EXISTS reservation_idempotency_keys (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id bigint NOT NULL,
+  idempotency_key varchar(255) NOT NULL,
+  livestream_id bigint NOT NULL,
+  waitlist_id bigint DEFAULT NULL,
+  created_at bigint NOT NULL,
+  UNIQUE KEY uniq_user_key (user_id, idempotency_key),
+  KEY waitlist_id (waitlist_id),
+  KEY created_at (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+CREATE TABLE IF NOT EXISTS reservation_waitlist (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id bigint NOT NULL,
+  start_at bigint NOT NULL,
+  end_at bigint NOT NULL,
+  request text NOT NULL,
+  created_at bigint NOT NULL,
+  KEY startend (start_at, end_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+CREATE TABLE IF NOT EXISTS tag_aliases (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  alias varchar(255) NOT NULL,
+  tag_id bigint NOT NULL,
+  UNIQUE KEY uniq_alias (alias)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+CREATE TABLE IF NOT EXISTS follows (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  follower_id bigint NOT NULL,
+  followee_id bigint NOT NULL,
+  created_at bigint NOT NULL,
+  UNIQUE KEY uniq_follow (follower_id, followee_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+CREATE TABLE IF NOT EXISTS livestream_watch_history (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id bigint NOT NULL,
+  livestream_id bigint NOT NULL,
+  viewed_at bigint NOT NULL,
+  UNIQUE KEY uniq_user_livestream (user_id, livestream_id),
+  KEY livestream_id (livestream_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+CREATE TABLE IF NOT EXISTS deleted_livestreams (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  livestream_id bigint NOT NULL,
+  deleted_at bigint NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+-- 入退室の記録。追記のみで、視聴者数推移の集計に使う
+CREATE TABLE IF NOT EXISTS livestream_viewer_events (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  livestream_id bigint NOT NULL,
+  user_id bigint NOT NULL,
+  delta bigint NOT NULL,
+  created_at bigint NOT NULL,
+  KEY livestream_id_created_at (livestream_id, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+-- 記録を始める前から視聴中のユーザは、入室時刻に入室したものとする
+INSERT INTO livestream_viewer_events (livestream_id, user_id, delta, created_at)
+SELECT livestream_id, user_id, 1, created_at FROM livestream_viewers_history;
+CREATE TABLE IF NOT EXISTS global_ng_words (
+  id bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  word varchar(255) NOT NULL,
+  created_at bigint NOT NULL,
+  UNIQUE KEY uniq_word (word)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
 ALTER TABLE themes ADD INDEX userid(user_id);
 ALTER TABLE reservation_slots ADD INDEX startend(start_at, end_at);
 ALTER TABLE reactions ADD INDEX livestreamidcreated(livestream_id, created_at);
 ALTER TABLE ng_words ADD INDEX userlivestreamid(user_id, livestream_id);
 ALTER TABLE livestream_tags ADD INDEX livestream_id(livestream_id);
+ALTER TABLE livestream_tags ADD UNIQUE INDEX livestream_tag(livestream_id, tag_id);
 ALTER TABLE livecomments ADD INDEX livestreamidcreated(livestream_id, created_at);
 ALTER TABLE livecomments ADD INDEX live(livestream_id);
 ALTER TABLE livecomments ADD INDEX user(user_id);
-ALTER TABLE livestream_viewers_history ADD INDEX userlivestreamid(user_id, livestream_id);
+ALTER TABLE livestream_viewers_history ADD UNIQUE INDEX userlivestreamid(user_id, livestream_id);
 ALTER TABLE livestreams ADD INDEX `user_id`(`user_id`);
+ALTER TABLE livestreams ADD INDEX updated_at(updated_at);
+ALTER TABLE livestreams ADD INDEX start_at(start_at);
+ALTER TABLE livestreams ADD INDEX end_at(end_at);
 ALTER TABLE reactions ADD INDEX livestreamidcreated(livestream_id, created_at);
 ALTER TABLE icons ADD INDEX userid(user_id);
 ALTER TABLE livecomment_reports ADD INDEX livecomment_reports(livecomment_id);
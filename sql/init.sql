@@ -1,25 +1,41 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
+TRUNCATE TABLE reservation_holds;
+TRUNCATE TABLE reservation_idempotency_keys;
+TRUNCATE TABLE reservation_waitlist;
 TRUNCATE TABLE livestream_viewers_history;
+TRUNCATE TABLE livestream_viewer_events;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
 TRUNCATE TABLE tags;
+TRUNCATE TABLE tag_aliases;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE livestream_watch_history;
+TRUNCATE TABLE deleted_livestreams;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
+ALTER TABLE `reservation_holds` auto_increment = 1;
+ALTER TABLE `reservation_idempotency_keys` auto_increment = 1;
+ALTER TABLE `reservation_waitlist` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
+ALTER TABLE `livestream_viewer_events` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
+ALTER TABLE `tag_aliases` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
+ALTER TABLE `livestream_watch_history` auto_increment = 1;
+ALTER TABLE `deleted_livestreams` auto_increment = 1;
\ No newline at end of file
@@ -15,6 +15,54 @@
 /*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;
 /*!40111 SET @OLD_SQL_NOTES=@@SQL_NOTES, SQL_NOTES=0 */;
 
+--
+-- Table structure for table `deleted_livestreams`
+--
+
+DROP TABLE IF EXISTS `deleted_livestreams`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `deleted_livestreams` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `livestream_id` bigint NOT NULL,
+  `deleted_at` bigint NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `follows`
+--
+
+DROP TABLE IF EXISTS `follows`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `follows` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `follower_id` bigint NOT NULL,
+  `followee_id` bigint NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_follow` (`follower_id`,`followee_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `global_ng_words`
+--
+
+DROP TABLE IF EXISTS `global_ng_words`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `global_ng_words` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `word` varchar(255) COLLATE utf8mb4_bin NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_word` (`word`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `icons`
 --
@@ -26,6 +74,7 @@ CREATE TABLE `icons` (
   `id` bigint NOT NULL AUTO_INCREMENT,
   `user_id` bigint NOT NULL,
   `image` longblob NOT NULL,
+  `hash` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
   PRIMARY KEY (`id`),
   KEY `userid` (`user_id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=349 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
@@ -82,10 +131,29 @@ CREATE TABLE `livestream_tags` (
   `livestream_id` bigint NOT NULL,
   `tag_id` bigint NOT NULL,
   PRIMARY KEY (`id`),
+  UNIQUE KEY `livestream_tag` (`livestream_id`,`tag_id`),
   KEY `livestream_id` (`livestream_id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=11699 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `livestream_viewer_events`
+--
+
+DROP TABLE IF EXISTS `livestream_viewer_events`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `livestream_viewer_events` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `livestream_id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  `delta` bigint NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `livestream_id_created_at` (`livestream_id`,`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `livestream_viewers_history`
 --
@@ -99,10 +167,28 @@ CREATE TABLE `livestream_viewers_history` (
   `livestream_id` bigint NOT NULL,
   `created_at` bigint NOT NULL,
   PRIMARY KEY (`id`),
-  KEY `userlivestreamid` (`user_id`,`livestream_id`)
+  UNIQUE KEY `userlivestreamid` (`user_id`,`livestream_id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=50 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `livestream_watch_history`
+--
+
+DROP TABLE IF EXISTS `livestream_watch_history`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `livestream_watch_history` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` bigint NOT NULL,
+  `livestream_id` bigint NOT NULL,
+  `viewed_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_user_livestream` (`user_id`,`livestream_id`),
+  KEY `livestream_id` (`livestream_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `livestreams`
 --
@@ -119,8 +205,21 @@ CREATE TABLE `livestreams` (
   `thumbnail_url` varchar(255) COLLATE utf8mb4_bin NOT NULL,
   `start_at` bigint NOT NULL,
   `end_at` bigint NOT NULL,
+  `created_at` bigint NOT NULL DEFAULT '0',
+  `is_archived` tinyint(1) NOT NULL DEFAULT '0',
+  `owner_name` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `owner_display_name` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `owner_icon_hash` varchar(255) COLLATE utf8mb4_bin NOT NULL DEFAULT '',
+  `version` bigint NOT NULL DEFAULT '0',
+  `current_viewers` bigint NOT NULL DEFAULT '0',
+  `reactions_count` bigint NOT NULL DEFAULT '0',
+  `peak_viewers` bigint NOT NULL DEFAULT '0',
+  `updated_at` datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
   PRIMARY KEY (`id`),
-  KEY `user_id` (`user_id`)
+  KEY `user_id` (`user_id`),
+  KEY `updated_at` (`updated_at`),
+  KEY `start_at` (`start_at`),
+  KEY `end_at` (`end_at`)
 ) ENGINE=InnoDB AUTO_INCREMENT=7658 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -161,6 +260,47 @@ CREATE TABLE `reactions` (
 ) ENGINE=InnoDB AUTO_INCREMENT=1450 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `reservation_holds`
+--
+
+DROP TABLE IF EXISTS `reservation_holds`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `reservation_holds` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `token` varchar(255) COLLATE utf8mb4_bin NOT NULL,
+  `user_id` bigint NOT NULL,
+  `start_at` bigint NOT NULL,
+  `end_at` bigint NOT NULL,
+  `expires_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_token` (`token`),
+  KEY `expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `reservation_idempotency_keys`
+--
+
+DROP TABLE IF EXISTS `reservation_idempotency_keys`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `reservation_idempotency_keys` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` bigint NOT NULL,
+  `idempotency_key` varchar(255) COLLATE utf8mb4_bin NOT NULL,
+  `livestream_id` bigint NOT NULL,
+  `waitlist_id` bigint DEFAULT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_user_key` (`user_id`,`idempotency_key`),
+  KEY `waitlist_id` (`waitlist_id`),
+  KEY `created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `reservation_slots`
 --
@@ -173,11 +313,47 @@ CREATE TABLE `reservation_slots` (
   `slot` bigint NOT NULL,
   `start_at` bigint NOT NULL,
   `end_at` bigint NOT NULL,
+  `initial_slot` bigint NOT NULL,
   PRIMARY KEY (`id`),
   KEY `startend` (`start_at`,`end_at`)
 ) ENGINE=InnoDB AUTO_INCREMENT=8760 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `reservation_waitlist`
+--
+
+DROP TABLE IF EXISTS `reservation_waitlist`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `reservation_waitlist` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` bigint NOT NULL,
+  `start_at` bigint NOT NULL,
+  `end_at` bigint NOT NULL,
+  `request` text COLLATE utf8mb4_bin NOT NULL,
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `startend` (`start_at`,`end_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `tag_aliases`
+--
+
+DROP TABLE IF EXISTS `tag_aliases`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE `tag_aliases` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `alias` varchar(255) COLLATE utf8mb4_bin NOT NULL,
+  `tag_id` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_alias` (`alias`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `tags`
 --
@@ -8,31 +8,20 @@ import (
 	"strconv"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
 type LivestreamStatistics struct {
-	Rank           int64 `json:"rank"`
-	ViewersCount   int64 `json:"viewers_count"`
-	TotalReactions int64 `json:"total_reactions"`
-	TotalReports   int64 `json:"total_reports"`
-	MaxTip         int64 `json:"max_tip"`
-}
-
-type LivestreamRankingEntry struct {
-	LivestreamID int64
-	Score        int64
-}
-type LivestreamRanking []LivestreamRankingEntry
-
-func (r LivestreamRanking) Len() int      { return len(r) }
-func (r LivestreamRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
-func (r LivestreamRanking) Less(i, j int) bool {
-	if r[i].Score == r[j].Score {
-		return r[i].LivestreamID < r[j].LivestreamID
-	} else {
-		return r[i].Score < r[j].Score
-	}
+	Rank         int64 `json:"rank"`
+	ViewersCount int64 `json:"viewers_count"`
+	// PeakViewers は同時視聴者数の最大値
+	PeakViewers       int64 `json:"peak_viewers"`
+	TotalReactions    int64 `json:"total_reactions"`
+	TotalReports      int64 `json:"total_reports"`
+	MaxTip            int64 `json:"max_tip"`
+	TotalLivecomments int64 `json:"total_livecomments"`
+	TotalTip          int64 `json:"total_tip"`
 }
 
 type UserStatistics struct {
@@ -44,6 +33,17 @@ type UserStatistics struct {
 	FavoriteEmoji     string `json:"favorite_emoji"`
 }
 
+type DashboardResponse struct {
+	LivestreamCount       int64        `json:"livestream_count"`
+	TotalReactions        int64        `json:"total_reactions"`
+	TotalTip              int64        `json:"total_tip"`
+	UnresolvedReportCount int64        `json:"unresolved_report_count"`
+	RecentLivestreams     []Livestream `json:"recent_livestreams"`
+}
+
+// ダッシュボードに表示する直近の配信数
+const dashboardRecentLivestreamsLimit = 5
+
 type UserRankingEntry struct {
 	Username string
 	Score    int64
@@ -72,7 +72,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -220,11 +220,16 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 
 	id, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "livestream_id in path must be integer")
 	}
 	livestreamID := int64(id)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -233,68 +238,50 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	var livestream LivestreamModel
 	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+			return newAPIError(http.StatusNotFound, "LIVESTREAM_NOT_FOUND", "not found livestream")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
 
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	if livestream.UserID != userID {
+		return newAPIError(http.StatusForbidden, "NOT_OWNER", "can't get other streamer's livestream statistics")
 	}
 
 	// ランク算出
-	var ranking LivestreamRanking
-	for _, livestream := range livestreams {
-		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
-		}
-
-		var totalTips int64
-		if err := tx.GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
-		}
-
-		score := reactions + totalTips
-		ranking = append(ranking, LivestreamRankingEntry{
-			LivestreamID: livestream.ID,
-			Score:        score,
-		})
-	}
-	sort.Sort(ranking)
-
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.LivestreamID == livestreamID {
-			break
-		}
-		rank++
+	// リアクション総数が多い配信ほど上位。同数ならIDが大きい配信を上位とする
+	var rank int64
+	query := `
+	SELECT COUNT(*) + 1
+	FROM livestreams
+	WHERE reactions_count > ? OR (reactions_count = ? AND id > ?)
+	`
+	if err := tx.GetContext(ctx, &rank, query, livestream.ReactionsCount, livestream.ReactionsCount, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to calculate livestream rank: "+err.Error())
 	}
 
 	// 視聴者数算出
 	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.GetContext(ctx, &viewersCount, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
 
-	// 最大チップ額
-	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
+	// ライブコメント数、チップ合計、最大チップ額
+	var livecommentStats struct {
+		TotalLivecomments int64 `db:"total_livecomments"`
+		TotalTip          int64 `db:"total_tip"`
+		MaxTip            int64 `db:"max_tip"`
+	}
+	if err := tx.GetContext(ctx, &livecommentStats, "SELECT COUNT(*) AS total_livecomments, IFNULL(SUM(tip), 0) AS total_tip, IFNULL(MAX(tip), 0) AS max_tip FROM livecomments WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to aggregate livecomments: "+err.Error())
 	}
 
 	// リアクション数
-	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
-	}
+	totalReactions := livestream.ReactionsCount
 
 	// スパム報告数
 	var totalReports int64
-	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.GetContext(ctx, &totalReports, "SELECT COUNT(*) FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
 	}
 
@@ -303,10 +290,162 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
+		Rank:              rank,
+		ViewersCount:      viewersCount,
+		PeakViewers:       livestream.PeakViewers,
+		MaxTip:            livecommentStats.MaxTip,
+		TotalReactions:    totalReactions,
+		TotalReports:      totalReports,
+		TotalLivecomments: livecommentStats.TotalLivecomments,
+		TotalTip:          livecommentStats.TotalTip,
 	})
 }
+
+// 配信者ダッシュボードAPI
+// GET /api/me/dashboard
+func getDashboardHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var dashboard DashboardResponse
+
+	if err := tx.GetContext(ctx, &dashboard.LivestreamCount, "SELECT COUNT(*) FROM livestreams WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestreams: "+err.Error())
+	}
+
+	if err := tx.GetContext(ctx, &dashboard.TotalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+	}
+
+	if err := tx.GetContext(ctx, &dashboard.TotalTip, "SELECT IFNULL(SUM(lc.tip), 0) FROM livestreams l INNER JOIN livecomments lc ON lc.livestream_id = l.id WHERE l.user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum total tip: "+err.Error())
+	}
+
+	// 報告されたライブコメントがモデレーションで削除されていないものを未対応とみなす
+	query := `
+	SELECT COUNT(*)
+	FROM
+		livestreams l
+		INNER JOIN livecomment_reports r ON r.livestream_id = l.id
+		INNER JOIN livecomments lc ON lc.id = r.livecomment_id
+	WHERE
+		l.user_id = ?
+	`
+	if err := tx.GetContext(ctx, &dashboard.UnresolvedReportCount, query, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unresolved reports: "+err.Error())
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, dashboardRecentLivestreamsLimit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	dashboard.RecentLivestreams = make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		dashboard.RecentLivestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, dashboard)
+}
+
+const (
+	defaultReactionRankingLimit = 20
+	maxReactionRankingLimit     = 100
+)
+
+type ReactionRankingEntry struct {
+	Rank           int64      `json:"rank"`
+	Livestream     Livestream `json:"livestream"`
+	TotalReactions int64      `json:"total_reactions"`
+	TotalTip       int64      `json:"total_tip"`
+}
+
+// リアクション数ランキングAPI
+// GET /api/livestream/ranking
+// リアクション数の多い順、同数ならチップ合計の多い順、さらに同じならIDの小さい順に並べる
+func getReactionRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultReactionRankingLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be positive integer")
+		}
+		if limit > maxReactionRankingLimit {
+			limit = maxReactionRankingLimit
+		}
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var rows []struct {
+		LivestreamModel
+		TotalReactions int64 `db:"total_reactions"`
+		TotalTip       int64 `db:"total_tip"`
+	}
+	query := `
+	SELECT
+		l.*,
+		l.reactions_count AS total_reactions,
+		IFNULL(lc.total_tip, 0) AS total_tip
+	FROM livestreams l
+	LEFT JOIN (SELECT livestream_id, SUM(tip) AS total_tip FROM livecomments GROUP BY livestream_id) lc ON lc.livestream_id = l.id
+	WHERE l.is_archived = FALSE
+	ORDER BY total_reactions DESC, total_tip DESC, l.id ASC
+	LIMIT ?
+	`
+	if err := tx.SelectContext(ctx, &rows, query, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction ranking: "+err.Error())
+	}
+
+	livestreamModels := make([]LivestreamModel, len(rows))
+	for i := range rows {
+		livestreamModels[i] = rows[i].LivestreamModel
+	}
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	ranking := make([]ReactionRankingEntry, len(rows))
+	for i := range rows {
+		ranking[i] = ReactionRankingEntry{
+			Rank:           int64(i + 1),
+			Livestream:     livestreams[i],
+			TotalReactions: rows[i].TotalReactions,
+			TotalTip:       rows[i].TotalTip,
+		}
+	}
+	return c.JSON(http.StatusOK, ranking)
+}
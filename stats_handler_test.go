@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLivestreamStatisticsPeakViewersAndRank(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, ownerID, "live", now-60, now+3600)
+	otherID := insertTestLivestream(t, ownerID, "other", now-60, now+3600)
+	if _, err := dbConn.Exec("UPDATE livestreams SET reactions_count = ? WHERE id = ?", 10, otherID); err != nil {
+		t.Fatalf("failed to set reactions_count: %+v", err)
+	}
+
+	path := "/api/livestream/" + strconv.FormatInt(livestreamID, 10)
+	viewerIDs := []int64{insertTestUser(t, "viewer1"), insertTestUser(t, "viewer2")}
+	for _, viewerID := range viewerIDs {
+		c, rec := newTestContext(t, http.MethodPost, path+"/enter", nil, viewerID)
+		c.SetParamNames("livestream_id")
+		c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+		if status := responseStatus(sessionMiddleware(livestreamMiddleware(enterLivestreamHandler))(c), rec); status != http.StatusOK {
+			t.Fatalf("enter: status = %d, want %d", status, http.StatusOK)
+		}
+	}
+	c, rec := newTestContext(t, http.MethodDelete, path+"/exit", nil, viewerIDs[0])
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+	if status := responseStatus(sessionMiddleware(livestreamMiddleware(exitLivestreamHandler))(c), rec); status != http.StatusOK {
+		t.Fatalf("exit: status = %d, want %d", status, http.StatusOK)
+	}
+
+	c, rec = newTestContext(t, http.MethodGet, path+"/statistics", nil, ownerID)
+	c.SetParamNames("livestream_id")
+	c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+	if status := responseStatus(getLivestreamStatisticsHandler(c), rec); status != http.StatusOK {
+		t.Fatalf("statistics: status = %d, want %d", status, http.StatusOK)
+	}
+	var stats LivestreamStatistics
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	if stats.PeakViewers != 2 {
+		t.Errorf("peak_viewers = %d, want 2", stats.PeakViewers)
+	}
+	// リアクションの多いotherの次
+	if stats.Rank != 2 {
+		t.Errorf("rank = %d, want 2", stats.Rank)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stmtCache はクエリ文字列ごとに、コネクションプールに対するプリペアドステートメントを保持する
+// sqlx.Stmt は並行に利用しても安全なので、リクエストをまたいで共有する
+type stmtCache struct {
+	mu    sync.RWMutex
+	stmts map[string]*sqlx.Stmt
+}
+
+var preparedStmts = &stmtCache{stmts: map[string]*sqlx.Stmt{}}
+
+// prepare はクエリに対応するプリペアドステートメントを返す。初回はプールに対してprepareする
+func (sc *stmtCache) prepare(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	sc.mu.RLock()
+	stmt, ok := sc.stmts[query]
+	sc.mu.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if stmt, ok := sc.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := dbConn.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	sc.stmts[query] = stmt
+	return stmt, nil
+}
+
+// txStmt はキャッシュしたステートメントをトランザクション内で使えるようにして返す
+// 返り値はトランザクション終了時に自動でクローズされる
+func (sc *stmtCache) txStmt(ctx context.Context, tx *sqlx.Tx, query string) (*sqlx.Stmt, error) {
+	stmt, err := sc.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.StmtxContext(ctx, stmt), nil
+}
+
+// close はキャッシュしたステートメントをすべてクローズする
+func (sc *stmtCache) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for query, stmt := range sc.stmts {
+		stmt.Close()
+		delete(sc.stmts, query)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 見つからないタグがあった場合に読み直す最短の間隔
+// 存在しないタグの指定が続いても、tagsの全件読み込みはこの間隔に1回までになる
+const tagCacheMissRefreshInterval = time.Second
+
+// tagCache はtagsテーブルのオンメモリキャッシュ
+// tagsは競技中ほぼ変化しないので起動時に読み込み、見つからないタグがあった場合のみ読み直す
+type tagCache struct {
+	mu       sync.RWMutex
+	loaded   bool
+	byID     map[int64]Tag
+	idByName map[string]int64
+	// aliasToID は別名から正規のタグIDへの対応
+	aliasToID map[string]int64
+	// refreshedAt は最後に読み直した時刻
+	refreshedAt time.Time
+
+	// missMu は見つからないタグによる読み直しを1つずつにする
+	missMu sync.Mutex
+}
+
+var tagsCache = &tagCache{}
+
+// refresh はtagsテーブルを読み直す
+func (tc *tagCache) refresh(ctx context.Context) error {
+	var tagModels []*TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return err
+	}
+
+	var aliasModels []*TagAliasModel
+	if err := dbConn.SelectContext(ctx, &aliasModels, "SELECT * FROM tag_aliases"); err != nil {
+		return err
+	}
+
+	byID := make(map[int64]Tag, len(tagModels))
+	idByName := make(map[string]int64, len(tagModels))
+	for _, tagModel := range tagModels {
+		byID[tagModel.ID] = Tag{
+			ID:   tagModel.ID,
+			Name: tagModel.Name,
+		}
+		idByName[tagModel.Name] = tagModel.ID
+	}
+	aliasToID := make(map[string]int64, len(aliasModels))
+	for _, aliasModel := range aliasModels {
+		aliasToID[aliasModel.Alias] = aliasModel.TagID
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.byID = byID
+	tc.idByName = idByName
+	tc.aliasToID = aliasToID
+	tc.loaded = true
+	tc.refreshedAt = time.Now()
+	return nil
+}
+
+// refreshOnMiss は見つからないタグがあった場合に読み直す
+// 直近に読み直していれば何もしないので、同時に来た取りこぼしも1回の読み直しにまとまる
+func (tc *tagCache) refreshOnMiss(ctx context.Context) error {
+	tc.missMu.Lock()
+	defer tc.missMu.Unlock()
+
+	tc.mu.RLock()
+	refreshedAt := tc.refreshedAt
+	tc.mu.RUnlock()
+	if time.Since(refreshedAt) < tagCacheMissRefreshInterval {
+		return nil
+	}
+	return tc.refresh(ctx)
+}
+
+// invalidate はキャッシュを破棄し、次回参照時に読み直させる
+// 実行中にタグを追加・変更した場合に呼ぶこと
+func (tc *tagCache) invalidate() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.loaded = false
+}
+
+func (tc *tagCache) ensureLoaded(ctx context.Context) error {
+	tc.mu.RLock()
+	loaded := tc.loaded
+	tc.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	return tc.refresh(ctx)
+}
+
+// all はすべてのタグをID順に返す
+func (tc *tagCache) all(ctx context.Context) ([]Tag, error) {
+	if err := tc.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+
+	tc.mu.RLock()
+	tags := make([]Tag, 0, len(tc.byID))
+	for _, tag := range tc.byID {
+		tags = append(tags, tag)
+	}
+	tc.mu.RUnlock()
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+	return tags, nil
+}
+
+// lookup はタグIDに対応するタグを返す。見つからないIDは無視する
+// キャッシュにないIDがあった場合は、直近に読み直していなければ一度だけ読み直す
+func (tc *tagCache) lookup(ctx context.Context, tagIDs []int64) (map[int64]Tag, error) {
+	if err := tc.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+
+	tags, missing := tc.lookupLoaded(tagIDs)
+	if !missing {
+		return tags, nil
+	}
+	if err := tc.refreshOnMiss(ctx); err != nil {
+		return nil, err
+	}
+	tags, _ = tc.lookupLoaded(tagIDs)
+	return tags, nil
+}
+
+func (tc *tagCache) lookupLoaded(tagIDs []int64) (map[int64]Tag, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+
+	tags := make(map[int64]Tag, len(tagIDs))
+	missing := false
+	for _, tagID := range tagIDs {
+		tag, ok := tc.byID[tagID]
+		if !ok {
+			missing = true
+			continue
+		}
+		tags[tagID] = tag
+	}
+	return tags, missing
+}
+
+// resolve はタグIDの並びをタグの並びに変換する。存在しないタグIDが含まれていればエラー
+func (tc *tagCache) resolve(ctx context.Context, tagIDs []int64) ([]Tag, error) {
+	tagMap, err := tc.lookup(ctx, tagIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]Tag, len(tagIDs))
+	for i, tagID := range tagIDs {
+		tag, ok := tagMap[tagID]
+		if !ok {
+			return nil, fmt.Errorf("tag %d not found", tagID)
+		}
+		tags[i] = tag
+	}
+	return tags, nil
+}
+
+// idByTagName はタグ名に対応するタグIDを返す
+// 別名が登録されている名前なら、別名の指す正規のタグIDを返す
+// 見つからない場合の読み直しはlookupと同じく間隔を空ける
+func (tc *tagCache) idByTagName(ctx context.Context, name string) (int64, bool, error) {
+	if err := tc.ensureLoaded(ctx); err != nil {
+		return 0, false, err
+	}
+
+	if tagID, ok := tc.idByTagNameLoaded(name); ok {
+		return tagID, true, nil
+	}
+
+	if err := tc.refreshOnMiss(ctx); err != nil {
+		return 0, false, err
+	}
+	tagID, ok := tc.idByTagNameLoaded(name)
+	return tagID, ok, nil
+}
+
+func (tc *tagCache) idByTagNameLoaded(name string) (int64, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if tagID, ok := tc.aliasToID[name]; ok {
+		return tagID, true
+	}
+	tagID, ok := tc.idByName[name]
+	return tagID, ok
+}
+
+// canonicalIDs はタグIDを正規のタグIDに変換する
+// 名前が別名として登録されているタグは、別名の指すタグに置き換える
+func (tc *tagCache) canonicalIDs(ctx context.Context, tagIDs []int64) ([]int64, error) {
+	if err := tc.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	canonical := make([]int64, len(tagIDs))
+	for i, tagID := range tagIDs {
+		canonical[i] = tagID
+		tag, ok := tc.byID[tagID]
+		if !ok {
+			continue
+		}
+		if aliasedID, ok := tc.aliasToID[tag.Name]; ok {
+			canonical[i] = aliasedID
+		}
+	}
+	return canonical, nil
+}
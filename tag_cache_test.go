@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 直近に読み直したばかりなら、見つからないタグでDBを引き直さない
+// dbConnはnilなので、読み直すとpanicする
+func TestTagCacheMissDoesNotRefreshWithinInterval(t *testing.T) {
+	tc := &tagCache{
+		loaded:      true,
+		byID:        map[int64]Tag{1: {ID: 1, Name: "ライブ配信"}},
+		idByName:    map[string]int64{"ライブ配信": 1},
+		aliasToID:   map[string]int64{},
+		refreshedAt: time.Now(),
+	}
+	ctx := context.Background()
+
+	tags, err := tc.lookup(ctx, []int64{1, 999})
+	if err != nil {
+		t.Fatalf("lookup: %+v", err)
+	}
+	if len(tags) != 1 || tags[1].Name != "ライブ配信" {
+		t.Errorf("lookup = %+v, want only tag 1", tags)
+	}
+
+	if _, ok, err := tc.idByTagName(ctx, "unknown"); err != nil || ok {
+		t.Errorf("idByTagName(unknown) = ok:%v err:%v, want not found", ok, err)
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -18,37 +21,185 @@ type TagModel struct {
 	Name string `db:"name"`
 }
 
+type TagAliasModel struct {
+	ID    int64  `db:"id"`
+	Alias string `db:"alias"`
+	TagID int64  `db:"tag_id"`
+}
+
+type TagAlias struct {
+	ID    int64  `json:"id"`
+	Alias string `json:"alias"`
+	TagID int64  `json:"tag_id"`
+}
+
+type PostTagAliasRequest struct {
+	Alias string `json:"alias"`
+	TagID int64  `json:"tag_id"`
+}
+
 type TagsResponse struct {
 	Tags []*Tag `json:"tags"`
 }
 
+type PopularTag struct {
+	ID              int64  `json:"id" db:"id"`
+	Name            string `json:"name" db:"name"`
+	LivestreamCount int64  `json:"livestream_count" db:"livestream_count"`
+}
+
+type PopularTagsResponse struct {
+	Tags []*PopularTag `json:"tags"`
+}
+
+type TrendingTagsResponse struct {
+	// Window は集計に使った期間 (例: "1h0m0s")
+	Window        string        `json:"window"`
+	WindowSeconds int64         `json:"window_seconds"`
+	Tags          []*PopularTag `json:"tags"`
+}
+
+// 人気タグ一覧のデフォルト件数
+const defaultPopularTagsLimit = 50
+
+const (
+	// 急上昇タグの集計期間のデフォルトと上限
+	defaultTrendingTagsWindow = time.Hour
+	maxTrendingTagsWindow     = 7 * 24 * time.Hour
+)
+
 func getTagHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tagList, err := tagsCache.all(ctx)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin new transaction: : "+err.Error()+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+
+	tags := make([]*Tag, len(tagList))
+	for i := range tagList {
+		tags[i] = &tagList[i]
+	}
+	return c.JSON(http.StatusOK, &TagsResponse{
+		Tags: tags,
+	})
+}
+
+// 人気タグ一覧API
+// GET /api/tag/popular
+func getPopularTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultPopularTagsLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be non-negative integer")
+		}
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var tagModels []*TagModel
-	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	tags := []*PopularTag{}
+	query := `
+	SELECT
+		tags.id,
+		tags.name,
+		COUNT(livestream_tags.id) AS livestream_count
+	FROM
+		tags
+		LEFT JOIN livestream_tags ON tags.id = livestream_tags.tag_id
+	GROUP BY
+		tags.id
+	ORDER BY
+		livestream_count DESC,
+		tags.id ASC
+	LIMIT ?
+	`
+	if err := tx.SelectContext(ctx, &tags, query, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get popular tags: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	tags := make([]*Tag, len(tagModels))
-	for i := range tagModels {
-		tags[i] = &Tag{
-			ID:   tagModels[i].ID,
-			Name: tagModels[i].Name,
+	return c.JSON(http.StatusOK, &PopularTagsResponse{
+		Tags: tags,
+	})
+}
+
+// 急上昇タグ一覧API
+// 直近window (デフォルト1h、上限7日) の間に作成された配信に付いた数の多い順にタグを返す
+// GET /api/tag/trending
+func getTrendingTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	window := defaultTrendingTagsWindow
+	if v := c.QueryParam("window"); v != "" {
+		var err error
+		window, err = time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "window query parameter must be positive duration (e.g. 1h, 24h)")
+		}
+		if window > maxTrendingTagsWindow {
+			window = maxTrendingTagsWindow
+		}
+	}
+
+	limit := defaultPopularTagsLimit
+	if c.QueryParam("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "limit query parameter must be non-negative integer")
 		}
 	}
-	return c.JSON(http.StatusOK, &TagsResponse{
-		Tags: tags,
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// created_atカラム追加前の配信は0なので、代わりに配信開始日時で集計する
+	tags := []*PopularTag{}
+	query := `
+	SELECT
+		tags.id,
+		tags.name,
+		COUNT(livestream_tags.id) AS livestream_count
+	FROM
+		livestreams
+		INNER JOIN livestream_tags ON livestreams.id = livestream_tags.livestream_id
+		INNER JOIN tags ON tags.id = livestream_tags.tag_id
+	WHERE
+		IF(livestreams.created_at > 0, livestreams.created_at, livestreams.start_at) >= ?
+	GROUP BY
+		tags.id
+	ORDER BY
+		livestream_count DESC,
+		tags.id ASC
+	LIMIT ?
+	`
+	since := time.Now().Add(-window).Unix()
+	if err := tx.SelectContext(ctx, &tags, query, since, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get trending tags: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &TrendingTagsResponse{
+		Window:        window.String(),
+		WindowSeconds: int64(window / time.Second),
+		Tags:          tags,
 	})
 }
 
@@ -65,7 +216,7 @@ func getStreamerThemeHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -74,7 +225,7 @@ func getStreamerThemeHandler(c echo.Context) error {
 	userModel := UserModel{}
 	err = tx.GetContext(ctx, &userModel, "SELECT id FROM users WHERE name = ?", username)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		return newAPIError(http.StatusNotFound, "USER_NOT_FOUND", "not found user that has the given username")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
@@ -96,3 +247,69 @@ func getStreamerThemeHandler(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, theme)
 }
+
+// タグ別名登録API (管理者用)
+// POST /api/admin/tag/alias
+// 検索や予約で別名を指定すると、別名の指すタグとして扱われる
+func postTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostTagAliasRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if req.Alias == "" {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "alias must not be empty")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ?", req.TagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, "TAG_NOT_FOUND", "not found tag")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+
+	// 既存のタグ名を別名にすると、そのタグが検索・予約で別のタグに置き換わってしまう
+	var sameNameTags int
+	if err := tx.GetContext(ctx, &sameNameTags, "SELECT COUNT(*) FROM tags WHERE name = ?", req.Alias); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	if sameNameTags > 0 {
+		return newAPIError(http.StatusConflict, "ALIAS_CONFLICT", "alias conflicts with an existing tag name")
+	}
+
+	aliasModel := TagAliasModel{
+		Alias: req.Alias,
+		TagID: req.TagID,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO tag_aliases (alias, tag_id) VALUES (:alias, :tag_id)", aliasModel)
+	if err != nil {
+		if isDuplicateEntryError(err) {
+			return newAPIError(http.StatusConflict, "ALIAS_CONFLICT", "alias already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+	aliasModel.ID, err = rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag alias id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	tagsCache.invalidate()
+
+	return c.JSON(http.StatusCreated, TagAlias{
+		ID:    aliasModel.ID,
+		Alias: aliasModel.Alias,
+		TagID: aliasModel.TagID,
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPostTagAliasRejectsExistingTagName(t *testing.T) {
+	setupTestDB(t)
+
+	if _, err := dbConn.Exec("INSERT INTO tags (name) VALUES ('ゲーム'), ('雑談')"); err != nil {
+		t.Fatalf("failed to insert tags: %+v", err)
+	}
+
+	for _, body := range []string{
+		// 他のタグの名前
+		`{"alias":"雑談","tag_id":1}`,
+		// 自分自身の名前
+		`{"alias":"ゲーム","tag_id":1}`,
+	} {
+		c, rec := newTestContext(t, http.MethodPost, "/api/admin/tag/alias", strings.NewReader(body), 0)
+		if status := responseStatus(postTagAliasHandler(c), rec); status != http.StatusConflict {
+			t.Errorf("%s: status = %d, want %d", body, status, http.StatusConflict)
+		}
+	}
+
+	var aliases int
+	if err := dbConn.Get(&aliases, "SELECT COUNT(*) FROM tag_aliases"); err != nil {
+		t.Fatalf("failed to count tag aliases: %+v", err)
+	}
+	if aliases != 0 {
+		t.Errorf("tag_aliases rows = %d, want 0", aliases)
+	}
+}
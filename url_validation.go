@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// normalizeLivestreamURL は配信のURLを検証し、前後の空白を除いて正規化したものを返す
+// http/httpsの絶対URLのみ受け付ける。allowedHostsが空でなければ、そのいずれかのホストに限る
+func normalizeLivestreamURL(field, raw string, allowedHosts []string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, "INVALID_URL", field+" must be a valid URL")
+	}
+	// url.Parseはスキームを小文字にするので、大文字のJAVASCRIPT:なども弾ける
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", newAPIError(http.StatusBadRequest, "INVALID_URL", field+" must be an http or https URL")
+	}
+	if u.Host == "" {
+		return "", newAPIError(http.StatusBadRequest, "INVALID_URL", field+" must be an absolute URL")
+	}
+	u.Host = strings.ToLower(u.Host)
+
+	if len(allowedHosts) > 0 {
+		allowed := false
+		for _, host := range allowedHosts {
+			if strings.EqualFold(u.Hostname(), host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", newAPIError(http.StatusBadRequest, "INVALID_URL", field+" host is not allowed")
+		}
+	}
+
+	return u.String(), nil
+}
+
+// normalizeThumbnailURL はサムネイルURLを正規化する
+// 未設定ならデフォルトのサムネイルを使うので、空のままにしておく
+func normalizeThumbnailURL(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+	return normalizeLivestreamURL("thumbnail_url", raw, nil)
+}
+
+// normalizeReservationURLs は予約リクエストのプレイリストURLとサムネイルURLを正規化して書き換える
+func normalizeReservationURLs(req *ReserveLivestreamRequest) error {
+	playlistURL, err := normalizeLivestreamURL("playlist_url", req.PlaylistUrl, playlistAllowedHosts)
+	if err != nil {
+		return err
+	}
+	thumbnailURL, err := normalizeThumbnailURL(req.ThumbnailUrl)
+	if err != nil {
+		return err
+	}
+	req.PlaylistUrl = playlistURL
+	req.ThumbnailUrl = thumbnailURL
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestNormalizeLivestreamURL(t *testing.T) {
+	allowedHosts := []string{"media.example.com"}
+	for _, tt := range []struct {
+		name         string
+		raw          string
+		allowedHosts []string
+		want         string
+		wantErr      bool
+	}{
+		{name: "https", raw: "https://media.example.com/live.m3u8", want: "https://media.example.com/live.m3u8"},
+		{name: "http", raw: "http://media.example.com/live.m3u8", want: "http://media.example.com/live.m3u8"},
+		{name: "trim spaces", raw: "  https://media.example.com/live.m3u8\n", want: "https://media.example.com/live.m3u8"},
+		{name: "lowercase host", raw: "https://Media.EXAMPLE.com/Live.m3u8", want: "https://media.example.com/Live.m3u8"},
+		{name: "allowed host", raw: "https://media.example.com/live.m3u8", allowedHosts: allowedHosts, want: "https://media.example.com/live.m3u8"},
+		{name: "allowed host ignores case and port", raw: "https://MEDIA.example.com:8443/live.m3u8", allowedHosts: allowedHosts, want: "https://media.example.com:8443/live.m3u8"},
+		{name: "host not allowed", raw: "https://evil.example.com/live.m3u8", allowedHosts: allowedHosts, wantErr: true},
+		{name: "subdomain not allowed", raw: "https://cdn.media.example.com/live.m3u8", allowedHosts: allowedHosts, wantErr: true},
+		{name: "javascript", raw: "javascript:alert(1)", wantErr: true},
+		{name: "uppercase javascript", raw: "JAVASCRIPT:alert(1)", wantErr: true},
+		{name: "javascript with spaces", raw: " JavaScript:alert(1)", wantErr: true},
+		{name: "relative path", raw: "/live.m3u8", wantErr: true},
+		{name: "scheme relative", raw: "//media.example.com/live.m3u8", wantErr: true},
+		{name: "missing host", raw: "https:///live.m3u8", wantErr: true},
+		{name: "other scheme", raw: "ftp://media.example.com/live.m3u8", wantErr: true},
+		{name: "empty", raw: "", wantErr: true},
+		{name: "invalid", raw: "https://media.example.com/%zz", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeLivestreamURL("playlist_url", tt.raw, tt.allowedHosts)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("normalizeLivestreamURL(%q) = %q, want error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeLivestreamURL(%q) returned error: %+v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeLivestreamURL(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeThumbnailURL(t *testing.T) {
+	for _, tt := range []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		// 未設定ならデフォルトのサムネイルを使う
+		{raw: "", want: ""},
+		{raw: "   ", want: ""},
+		{raw: " https://IMG.example.com/thumb.jpg ", want: "https://img.example.com/thumb.jpg"},
+		// プレイリストの許可ホストには制限されない
+		{raw: "https://evil.example.com/thumb.jpg", want: "https://evil.example.com/thumb.jpg"},
+		{raw: "Javascript:alert(1)", wantErr: true},
+		{raw: "thumb.jpg", wantErr: true},
+	} {
+		got, err := normalizeThumbnailURL(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeThumbnailURL(%q) = %q, want error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeThumbnailURL(%q) returned error: %+v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeThumbnailURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -30,6 +31,16 @@ const (
 
 var fallbackImage = "../img/NoImage.jpg"
 
+// fallbackImageのsha256
+const fallbackImageHash = "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
+
+// ユーザ一括取得APIで一度に指定できるユーザ数 (IDと名前の合計)
+const maxResolveUsers = 100
+
+// レスポンスにアイコンを埋め込む際の上限サイズ
+// これを超えるアイコンは埋め込まず、icon_hashから/api/user/:username/iconで取得してもらう
+const maxInlineIconSize = 1 << 20
+
 type UserModel struct {
 	ID             int64  `db:"id"`
 	Name           string `db:"name"`
@@ -45,6 +56,8 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// Icon はinclude_icon指定時のみ埋め込まれるアイコン画像 (JSONではbase64)
+	Icon []byte `json:"icon,omitempty"`
 }
 
 type Theme struct {
@@ -77,6 +90,11 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type ResolveUsersRequest struct {
+	IDs   []int64  `json:"ids"`
+	Names []string `json:"names"`
+}
+
 type PostIconRequest struct {
 	Image []byte `json:"image"`
 }
@@ -85,14 +103,99 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
+// backfillIconHashes は画像を持つアイコンのhashを画像から計算して埋める
+// hashカラム追加前のアイコンのための移行処理で、初期化時に呼ぶ
+// 既にhashがあるものは以前のように画像から計算した値と一致するか確かめ、食い違っていれば直す
+func backfillIconHashes(ctx context.Context) error {
+	rows, err := dbConn.QueryxContext(ctx, "SELECT id, hash, image FROM icons WHERE LENGTH(image) > 0")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type iconHashUpdate struct {
+		ID   int64  `db:"id"`
+		Hash string `db:"hash"`
+	}
+	var updates []iconHashUpdate
+	for rows.Next() {
+		var icon struct {
+			ID    int64  `db:"id"`
+			Hash  string `db:"hash"`
+			Image []byte `db:"image"`
+		}
+		if err := rows.StructScan(&icon); err != nil {
+			return err
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(icon.Image))
+		if icon.Hash == hash {
+			continue
+		}
+		if icon.Hash != "" {
+			log.Printf("icon %d has hash %s but its image hashes to %s", icon.ID, icon.Hash, hash)
+		}
+		updates = append(updates, iconHashUpdate{ID: icon.ID, Hash: hash})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		if _, err := dbConn.NamedExecContext(ctx, "UPDATE icons SET hash = :hash WHERE id = :id", update); err != nil {
+			return err
+		}
+	}
+	if len(updates) > 0 {
+		log.Printf("backfilled hashes of %d icons", len(updates))
+	}
+	return nil
+}
+
+// readUserIcon はユーザのアイコン画像を読み込む
+// アイコン未登録のユーザにはfallbackImageを返す
+func readUserIcon(username string) ([]byte, error) {
+	image, err := os.ReadFile("../img/icon/" + username)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.ReadFile(fallbackImage)
+	}
+	return image, err
+}
+
+// アイコン取得API
+// GET /api/user/:username/icon
+// Rangeリクエストに対応し、途中からの読み込みには206で部分的に返す
+// ETagはicon_hashと同じ値なので、クライアントはicon_hashでIf-None-Matchを送れば304を受け取れる
 func getIconHandler(c echo.Context) error {
 	username := c.Param("username")
 
 	filename := "../img/icon/" + username
-	if _, err := os.Stat(filename); err != nil {
-		return c.File(fallbackImage)
+	isFallback := false
+	f, err := os.Open(filename)
+	if err != nil {
+		filename = fallbackImage
+		isFallback = true
+		if f, err = os.Open(filename); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to open icon: "+err.Error())
+		}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to stat icon: "+err.Error())
 	}
-	return c.File(filename)
+
+	iconHash := fallbackImageHash
+	if !isFallback {
+		if iconHash, err = iconHashes.hash(filename, f, info); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to hash icon: "+err.Error())
+		}
+	}
+
+	// ServeContentがETagを見てIf-None-MatchやIf-Rangeを処理する
+	// Content-Typeは先頭を読んで判定してくれるので、ファイル全体を読み込まずに返せる
+	c.Response().Header().Set("ETag", `"`+iconHash+`"`)
+	http.ServeContent(c.Response(), c.Request(), "", info.ModTime(), f)
+	return nil
 }
 
 func postIconHandler(c echo.Context) error {
@@ -108,7 +211,7 @@ func postIconHandler(c echo.Context) error {
 
 	var req *PostIconRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
 	}
 
 	username := sess.Values[defaultUsernameKey].(string)
@@ -142,6 +245,11 @@ func postIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
 	}
 
+	// 配信に複製している配信者のアイコンハッシュも更新する
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET owner_icon_hash = ? WHERE user_id = ?", iconHashHex, userId); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream owner icon: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
@@ -164,7 +272,7 @@ func getMeHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -173,7 +281,7 @@ func getMeHandler(c echo.Context) error {
 	userModel := UserModel{}
 	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		return newAPIError(http.StatusNotFound, "USER_NOT_FOUND", "not found user that has the userid in session")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
@@ -199,7 +307,7 @@ func registerHandler(c echo.Context) error {
 
 	req := PostUserRequest{}
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
 	}
 
 	if req.Name == "pipe" {
@@ -268,7 +376,7 @@ func loginHandler(c echo.Context) error {
 
 	req := LoginRequest{}
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -281,7 +389,7 @@ func loginHandler(c echo.Context) error {
 	// usernameはUNIQUEなので、whereで一意に特定できる
 	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		return newAPIError(http.StatusUnauthorized, "INVALID_CREDENTIALS", "invalid username or password")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
@@ -293,7 +401,7 @@ func loginHandler(c echo.Context) error {
 
 	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		return newAPIError(http.StatusUnauthorized, "INVALID_CREDENTIALS", "invalid username or password")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
@@ -313,6 +421,11 @@ func loginHandler(c echo.Context) error {
 		MaxAge: int(60000),
 		Path:   "/",
 	}
+	// 別サイトのオリジンからのリクエストにもCookieを送らせるにはSameSite=None (Secure必須) が必要
+	if len(corsAllowOrigins) > 0 {
+		sess.Options.SameSite = http.SameSiteNoneMode
+		sess.Options.Secure = true
+	}
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
@@ -336,7 +449,7 @@ func getUserHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := beginReadOnlyTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -345,21 +458,99 @@ func getUserHandler(c echo.Context) error {
 	userModel := UserModel{}
 	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			return newAPIError(http.StatusNotFound, "USER_NOT_FOUND", "not found user that has the given username")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	user, err := fillUserResponseShared(ctx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
+	return c.JSON(http.StatusOK, user)
+}
+
+// ユーザ一括取得API
+// POST /api/users/resolve
+// ID・ユーザ名で指定したユーザをまとめて返す。存在しないものは結果に含めない
+// 順序はidsの順、続いてnamesの順で、同じユーザは1度だけ返す。アイコンは画像ではなくicon_hashで返す
+func resolveUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *ResolveUsersRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return newAPIError(http.StatusBadRequest, "INVALID_JSON", "failed to decode the request body as json")
+	}
+	if len(req.IDs)+len(req.Names) > maxResolveUsers {
+		return newAPIError(http.StatusBadRequest, "TOO_MANY_USERS", fmt.Sprintf("at most %d users can be resolved at once", maxResolveUsers))
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userMap, err := getUserMap(ctx, tx, req.IDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	nameMap := make(map[string]User, len(req.Names))
+	if len(req.Names) > 0 {
+		var userModels []UserModel
+		query, params, err := sqlx.In("SELECT * FROM users WHERE name IN (?)", req.Names)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		}
+		users, err := fillUserResponses(ctx, tx, userModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+		}
+		for _, user := range users {
+			nameMap[user.Name] = user
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, user)
+	users := make([]User, 0, len(req.IDs)+len(req.Names))
+	seen := make(map[int64]struct{}, len(req.IDs)+len(req.Names))
+	add := func(user User, ok bool) {
+		if !ok {
+			return
+		}
+		if _, dup := seen[user.ID]; dup {
+			return
+		}
+		seen[user.ID] = struct{}{}
+		users = append(users, user)
+	}
+	for _, id := range req.IDs {
+		user, ok := userMap[id]
+		add(user, ok)
+	}
+	for _, name := range req.Names {
+		user, ok := nameMap[name]
+		add(user, ok)
+	}
+
+	return c.JSON(http.StatusOK, users)
 }
 
 func verifyUserSession(c echo.Context) error {
@@ -380,7 +571,7 @@ func verifyUserSession(c echo.Context) error {
 
 	now := time.Now()
 	if now.Unix() > sessionExpires.(int64) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+		return newAPIError(http.StatusUnauthorized, "SESSION_EXPIRED", "session has expired")
 	}
 
 	return nil
@@ -397,7 +588,7 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 		if !errors.Is(err, sql.ErrNoRows) {
 			return User{}, err
 		}
-		iconHash = "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
+		iconHash = fallbackImageHash
 	}
 
 	user := User{
@@ -414,3 +605,97 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 
 	return user, nil
 }
+
+// fillUserResponses は複数ユーザのレスポンスをまとめて組み立てる
+// テーマとアイコンはユーザ数によらずそれぞれ1クエリで取得する
+func fillUserResponses(ctx context.Context, tx *sqlx.Tx, userModels []UserModel) ([]User, error) {
+	users := make([]User, len(userModels))
+	if len(userModels) == 0 {
+		return users, nil
+	}
+
+	userIDs := make([]int64, len(userModels))
+	for i := range userModels {
+		userIDs[i] = userModels[i].ID
+	}
+
+	var themeModels []ThemeModel
+	query, params, err := sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &themeModels, query, params...); err != nil {
+		return nil, err
+	}
+	themeMap := make(map[int64]ThemeModel, len(themeModels))
+	for _, themeModel := range themeModels {
+		themeMap[themeModel.UserID] = themeModel
+	}
+
+	var iconModels []struct {
+		UserID int64  `db:"user_id"`
+		Hash   string `db:"hash"`
+	}
+	query, params, err = sqlx.In("SELECT user_id, hash FROM icons WHERE user_id IN (?)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &iconModels, query, params...); err != nil {
+		return nil, err
+	}
+	iconHashMap := make(map[int64]string, len(iconModels))
+	for _, iconModel := range iconModels {
+		iconHashMap[iconModel.UserID] = iconModel.Hash
+	}
+
+	for i, userModel := range userModels {
+		themeModel, ok := themeMap[userModel.ID]
+		if !ok {
+			return nil, fmt.Errorf("theme of user %d: %w", userModel.ID, sql.ErrNoRows)
+		}
+		iconHash, ok := iconHashMap[userModel.ID]
+		if !ok {
+			iconHash = fallbackImageHash
+		}
+
+		users[i] = User{
+			ID:          userModel.ID,
+			Name:        userModel.Name,
+			DisplayName: userModel.DisplayName,
+			Description: userModel.Description,
+			Theme: Theme{
+				ID:       themeModel.ID,
+				DarkMode: themeModel.DarkMode,
+			},
+			IconHash: iconHash,
+		}
+	}
+
+	return users, nil
+}
+
+// getUserMap はユーザIDからユーザをまとめて引き、IDをキーにしたmapで返す
+// 存在しないIDはmapに含まれない
+func getUserMap(ctx context.Context, tx *sqlx.Tx, userIDs []int64) (map[int64]User, error) {
+	userMap := make(map[int64]User, len(userIDs))
+	if len(userIDs) == 0 {
+		return userMap, nil
+	}
+
+	var userModels []UserModel
+	query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
+		return nil, err
+	}
+	users, err := fillUserResponses(ctx, tx, userModels)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		userMap[user.ID] = user
+	}
+	return userMap, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 視聴者数のカウンタを視聴履歴と突き合わせる間隔
+const viewerCountReconcileInterval = time.Minute
+
+// adjustCurrentViewers は配信の視聴者数カウンタをexited減らしてentered増やす
+// 同時に入退室しても更新が失われないよう、読み出した値ではなくSQLの中で増減する
+// 減らす際は0未満にならないようにする
+func adjustCurrentViewers(ctx context.Context, tx *sqlx.Tx, livestreamID, exited, entered int64) error {
+	if exited == 0 && entered == 0 {
+		return nil
+	}
+	// MySQLのUPDATEは左から順に代入するので、peak_viewersには更新後のcurrent_viewersが使われる
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET current_viewers = GREATEST(current_viewers - ?, 0) + ?, peak_viewers = GREATEST(peak_viewers, current_viewers) WHERE id = ?", exited, entered, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream viewers count: "+err.Error())
+	}
+	return nil
+}
+
+// recordViewerEvent は入退室をlivestream_viewer_eventsに追記する。deltaは入室なら正、退室なら負
+// 視聴履歴は退室で消えるので、視聴者数推移はこちらから集計する
+func recordViewerEvent(ctx context.Context, tx *sqlx.Tx, livestreamID, userID, delta, createdAt int64) error {
+	if delta == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_viewer_events (livestream_id, user_id, delta, created_at) VALUES (?, ?, ?, ?)", livestreamID, userID, delta, createdAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_viewer_event: "+err.Error())
+	}
+	return nil
+}
+
+type viewerCountMismatch struct {
+	ID             int64 `db:"id"`
+	CurrentViewers int64 `db:"current_viewers"`
+	Count          int64 `db:"count"`
+}
+
+// reconcileViewerCounts は視聴者数カウンタを視聴履歴の件数に合わせ直し、直した配信数を返す
+// カウンタの導入前に入室していた分や、カウンタだけが更新された不整合を直す
+// 異常終了したセッションの視聴履歴自体は、再接続時の視聴再開APIで消される
+// 複数テーブルのUPDATEは読んだ行すべてをロックして入退室を止めるので、ずれた配信をロックなしで探してから1件ずつ直す
+func reconcileViewerCounts(ctx context.Context) (int64, error) {
+	query := `
+	SELECT livestreams.id, livestreams.current_viewers, COALESCE(viewers.count, 0) AS count
+	FROM livestreams
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS count
+		FROM livestream_viewers_history
+		GROUP BY livestream_id
+	) AS viewers ON viewers.livestream_id = livestreams.id
+	WHERE livestreams.current_viewers <> COALESCE(viewers.count, 0)
+	`
+	var mismatches []viewerCountMismatch
+	if err := dbConn.SelectContext(ctx, &mismatches, query); err != nil {
+		return 0, err
+	}
+
+	var fixed int64
+	for _, m := range mismatches {
+		// 読んでから入退室があった配信は、その時点でカウンタも動いているので次回に回す
+		rs, err := dbConn.ExecContext(ctx, "UPDATE livestreams SET current_viewers = ?, peak_viewers = GREATEST(peak_viewers, ?) WHERE id = ? AND current_viewers = ?", m.Count, m.Count, m.ID, m.CurrentViewers)
+		if err != nil {
+			return fixed, err
+		}
+		n, err := rs.RowsAffected()
+		if err != nil {
+			return fixed, err
+		}
+		fixed += n
+	}
+	return fixed, nil
+}
+
+// runViewerCountReconciler は定期的に視聴者数カウンタを視聴履歴と突き合わせ続ける
+func runViewerCountReconciler(logger echo.Logger) {
+	ticker := time.NewTicker(viewerCountReconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fixed, err := reconcileViewerCounts(context.Background())
+		if err != nil {
+			logger.Warnf("failed to reconcile viewer counts: %+v", err)
+			continue
+		}
+		if fixed > 0 {
+			logger.Warnf("fixed viewer counts of %d livestreams", fixed)
+		}
+	}
+}
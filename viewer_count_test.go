@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReconcileViewerCounts(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	viewerID := insertTestUser(t, "viewer")
+	now := time.Now().Unix()
+	driftedID := insertTestLivestream(t, ownerID, "drifted", now-60, now+3600)
+	consistentID := insertTestLivestream(t, ownerID, "consistent", now-60, now+3600)
+
+	// driftedはカウンタだけが進み、consistentは視聴履歴とカウンタが合っている
+	if _, err := dbConn.Exec("UPDATE livestreams SET current_viewers = 3, peak_viewers = 3 WHERE id = ?", driftedID); err != nil {
+		t.Fatalf("failed to drift current_viewers: %+v", err)
+	}
+	if _, err := dbConn.Exec("INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES (?, ?, ?)", viewerID, consistentID, now); err != nil {
+		t.Fatalf("failed to insert viewer: %+v", err)
+	}
+	if _, err := dbConn.Exec("UPDATE livestreams SET current_viewers = 1, peak_viewers = 1 WHERE id = ?", consistentID); err != nil {
+		t.Fatalf("failed to set current_viewers: %+v", err)
+	}
+
+	fixed, err := reconcileViewerCounts(context.Background())
+	if err != nil {
+		t.Fatalf("failed to reconcile viewer counts: %+v", err)
+	}
+	if fixed != 1 {
+		t.Errorf("fixed = %d, want 1", fixed)
+	}
+
+	for id, want := range map[int64]int64{driftedID: 0, consistentID: 1} {
+		var currentViewers int64
+		if err := dbConn.Get(&currentViewers, "SELECT current_viewers FROM livestreams WHERE id = ?", id); err != nil {
+			t.Fatalf("failed to get current_viewers: %+v", err)
+		}
+		if currentViewers != want {
+			t.Errorf("livestream %d: current_viewers = %d, want %d", id, currentViewers, want)
+		}
+	}
+}
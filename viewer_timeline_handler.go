@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultViewerTimelineBucket = time.Minute
+	// これより細かい区切りは指定できない
+	minViewerTimelineBucket = time.Minute
+	// 1回に返す区間の上限
+	maxViewerTimelineBuckets = 1440
+)
+
+type ViewerTimelinePoint struct {
+	// Timestamp は区間の開始時刻 (UNIX秒)
+	Timestamp int64 `json:"timestamp"`
+	Count     int64 `json:"count"`
+}
+
+// 視聴者数推移API (配信者向け)
+// GET /api/livestream/:livestream_id/viewers/timeline
+// 配信開始から配信終了(配信中なら現在)までをbucketごとに区切り、各区間の終わりの時点の視聴者数を返す
+// 入退室の記録 (livestream_viewer_events) を区間の終わりまで足し合わせて数える
+// セッション、配信の存在、配信者本人であることはミドルウェアで確認済み
+func getLivestreamViewerTimelineHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamModel := livestreamFromContext(c)
+
+	bucket := defaultViewerTimelineBucket
+	if v := c.QueryParam("bucket"); v != "" {
+		var err error
+		bucket, err = time.ParseDuration(v)
+		if err != nil || bucket <= 0 {
+			return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", "bucket query parameter must be positive duration (e.g. 1m, 1h)")
+		}
+		if bucket < minViewerTimelineBucket {
+			bucket = minViewerTimelineBucket
+		}
+	}
+	step := int64(bucket / time.Second)
+
+	from := livestreamModel.StartAt
+	to := livestreamModel.EndAt
+	if now := requestTime(ctx).Unix(); now < to {
+		to = now
+	}
+	timeline := []ViewerTimelinePoint{}
+	if from >= to {
+		return c.JSON(http.StatusOK, timeline)
+	}
+	if (to-from+step-1)/step > maxViewerTimelineBuckets {
+		return newAPIError(http.StatusBadRequest, "INVALID_PARAMETER", fmt.Sprintf("bucket query parameter is too small: at most %d buckets can be returned", maxViewerTimelineBuckets))
+	}
+
+	var events []struct {
+		Delta     int64 `db:"delta"`
+		CreatedAt int64 `db:"created_at"`
+	}
+	if err := dbConn.SelectContext(ctx, &events, "SELECT delta, created_at FROM livestream_viewer_events WHERE livestream_id = ? AND created_at < ? ORDER BY created_at, id", livestreamModel.ID, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream viewer events: "+err.Error())
+	}
+
+	var count int64
+	i := 0
+	for start := from; start < to; start += step {
+		end := start + step
+		if end > to {
+			end = to
+		}
+		for ; i < len(events) && events[i].CreatedAt < end; i++ {
+			count += events[i].Delta
+		}
+		// 記録を始める前から視聴していたユーザの退室で負にならないようにする
+		timeline = append(timeline, ViewerTimelinePoint{Timestamp: start, Count: max(count, 0)})
+	}
+
+	return c.JSON(http.StatusOK, timeline)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestViewerTimelineCountsExitedViewers(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	now := time.Now().Unix()
+	startAt := now - 3*60
+	livestreamID := insertTestLivestream(t, ownerID, "live", startAt, now+3600)
+
+	// 1分目に2人が入室し、2分目に1人が退室する
+	for _, event := range []struct {
+		userID    int64
+		delta     int64
+		createdAt int64
+	}{
+		{userID: 1, delta: 1, createdAt: startAt + 10},
+		{userID: 2, delta: 1, createdAt: startAt + 20},
+		{userID: 1, delta: -1, createdAt: startAt + 70},
+	} {
+		if _, err := dbConn.Exec("INSERT INTO livestream_viewer_events (livestream_id, user_id, delta, created_at) VALUES (?, ?, ?, ?)", livestreamID, event.userID, event.delta, event.createdAt); err != nil {
+			t.Fatalf("failed to insert viewer event: %+v", err)
+		}
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.Get(&livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		t.Fatalf("failed to get livestream: %+v", err)
+	}
+	c, rec := newTestContext(t, http.MethodGet, "/api/livestream/"+strconv.FormatInt(livestreamID, 10)+"/viewers/timeline?bucket=1m", nil, ownerID)
+	c.Set(livestreamContextKey, livestreamModel)
+	if status := responseStatus(getLivestreamViewerTimelineHandler(c), rec); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+
+	var timeline []ViewerTimelinePoint
+	if err := json.Unmarshal(rec.Body.Bytes(), &timeline); err != nil {
+		t.Fatalf("failed to decode response: %+v", err)
+	}
+	want := []int64{2, 1, 1}
+	if len(timeline) < len(want) {
+		t.Fatalf("got %d points, want at least %d", len(timeline), len(want))
+	}
+	for i, count := range want {
+		if timeline[i].Count != count {
+			t.Errorf("timeline[%d].count = %d, want %d", i, timeline[i].Count, count)
+		}
+	}
+}
+
+func TestEnterExitResumeRecordViewerEvents(t *testing.T) {
+	setupTestDB(t)
+
+	ownerID := insertTestUser(t, "owner")
+	viewerID := insertTestUser(t, "viewer")
+	now := time.Now().Unix()
+	livestreamID := insertTestLivestream(t, ownerID, "live", now-60, now+3600)
+	path := "/api/livestream/" + strconv.FormatInt(livestreamID, 10)
+
+	for _, step := range []struct {
+		name    string
+		handler func() error
+	}{
+		{name: "enter", handler: func() error {
+			c, _ := newTestContext(t, http.MethodPost, path+"/enter", nil, viewerID)
+			c.SetParamNames("livestream_id")
+			c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+			return sessionMiddleware(livestreamMiddleware(enterLivestreamHandler))(c)
+		}},
+		{name: "resume", handler: func() error {
+			c, _ := newTestContext(t, http.MethodPost, path+"/resume", nil, viewerID)
+			c.SetParamNames("livestream_id")
+			c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+			return resumeLivestreamHandler(c)
+		}},
+		{name: "exit", handler: func() error {
+			c, _ := newTestContext(t, http.MethodDelete, path+"/exit", nil, viewerID)
+			c.SetParamNames("livestream_id")
+			c.SetParamValues(strconv.FormatInt(livestreamID, 10))
+			return sessionMiddleware(livestreamMiddleware(exitLivestreamHandler))(c)
+		}},
+	} {
+		if err := step.handler(); err != nil {
+			t.Fatalf("%s: %+v", step.name, err)
+		}
+	}
+
+	var deltas []int64
+	if err := dbConn.Select(&deltas, "SELECT delta FROM livestream_viewer_events WHERE livestream_id = ? AND user_id = ? ORDER BY id", livestreamID, viewerID); err != nil {
+		t.Fatalf("failed to get viewer events: %+v", err)
+	}
+	// enter, resume (退室と入室), exit の順
+	want := []int64{1, -1, 1, -1}
+	if len(deltas) != len(want) {
+		t.Fatalf("deltas = %v, want %v", deltas, want)
+	}
+	for i := range want {
+		if deltas[i] != want[i] {
+			t.Errorf("deltas = %v, want %v", deltas, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// errReservationSlotFull は予約区間に空きのない予約枠があることを表す
+// reserveSlotsが返すHTTPErrorのInternalに入るので、errors.Isで判定できる
+var errReservationSlotFull = errors.New("reservation slot is full")
+
+type ReservationWaitlistModel struct {
+	ID      int64 `db:"id"`
+	UserID  int64 `db:"user_id"`
+	StartAt int64 `db:"start_at"`
+	EndAt   int64 `db:"end_at"`
+	// Request は繰り上げ時に配信を作るための予約リクエスト (JSON)
+	Request   string `db:"request"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID      int64 `json:"id"`
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// Position は同じ時間帯に重なるキャンセル待ちの中での順番 (1始まり)
+	Position  int64 `json:"position"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// enqueueWaitlist は予約リクエストをキャンセル待ちに追加する
+// 予約枠のロックを持ったまま呼ぶことで、直後のキャンセルによる繰り上げと取りこぼしなく直列化される
+func enqueueWaitlist(ctx context.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest, now time.Time) (ReservationWaitlistEntry, error) {
+	request, err := json.Marshal(req)
+	if err != nil {
+		return ReservationWaitlistEntry{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to encode reservation request: "+err.Error())
+	}
+
+	waitlistModel := ReservationWaitlistModel{
+		UserID:    userID,
+		StartAt:   req.StartAt,
+		EndAt:     req.EndAt,
+		Request:   string(request),
+		CreatedAt: now.Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, start_at, end_at, request, created_at) VALUES (:user_id, :start_at, :end_at, :request, :created_at)", waitlistModel)
+	if err != nil {
+		return ReservationWaitlistEntry{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation waitlist: "+err.Error()).SetInternal(err)
+	}
+	waitlistID, err := rs.LastInsertId()
+	if err != nil {
+		return ReservationWaitlistEntry{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted waitlist id: "+err.Error())
+	}
+
+	waitlistModel.ID = waitlistID
+
+	return waitlistEntry(ctx, tx, waitlistModel)
+}
+
+// waitlistEntry はキャンセル待ちに、同じ時間帯に重なるキャンセル待ちの中での順番を付けて返す
+func waitlistEntry(ctx context.Context, tx *sqlx.Tx, waitlistModel ReservationWaitlistModel) (ReservationWaitlistEntry, error) {
+	var position int64
+	if err := tx.GetContext(ctx, &position, "SELECT COUNT(*) FROM reservation_waitlist WHERE start_at < ? AND end_at > ? AND id <= ?", waitlistModel.EndAt, waitlistModel.StartAt, waitlistModel.ID); err != nil {
+		return ReservationWaitlistEntry{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count reservation waitlist: "+err.Error()).SetInternal(err)
+	}
+
+	return ReservationWaitlistEntry{
+		ID:        waitlistModel.ID,
+		StartAt:   waitlistModel.StartAt,
+		EndAt:     waitlistModel.EndAt,
+		Position:  position,
+		CreatedAt: waitlistModel.CreatedAt,
+	}, nil
+}
+
+// promoteWaitlist は予約枠が空いた区間に重なるキャンセル待ちを古い順に見て、予約できるものから配信を作る
+// 呼び出し側で空いた予約枠を戻した後、同じトランザクションで呼ぶ
+func promoteWaitlist(ctx context.Context, logger echo.Logger, tx *sqlx.Tx, startAt, endAt int64) (int, error) {
+	// 同じキャンセル待ちを並列に繰り上げないようロックする
+	var waitlistModels []ReservationWaitlistModel
+	if err := tx.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE start_at < ? AND end_at > ? ORDER BY id FOR UPDATE", endAt, startAt); err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error()).SetInternal(err)
+	}
+
+	promoted := 0
+	for _, waitlistModel := range waitlistModels {
+		var req ReserveLivestreamRequest
+		if err := json.Unmarshal([]byte(waitlistModel.Request), &req); err != nil {
+			return promoted, echo.NewHTTPError(http.StatusInternalServerError, "failed to decode waitlisted request: "+err.Error())
+		}
+
+		// 予約枠を減らす前に確かめられるものを確かめる
+		tagIDs, err := validateTagIDs(ctx, tx, req.Tags)
+		if err == nil {
+			err = reserveSlots(ctx, logger, tx, waitlistModel.StartAt, waitlistModel.EndAt)
+		}
+		if err != nil {
+			if errors.Is(err, errReservationSlotFull) {
+				continue
+			}
+			var he *echo.HTTPError
+			if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+				return promoted, err
+			}
+			// タグが消えたなどで予約できなくなったものは、待っていても予約できないので取り除く
+			logger.Warnf("dropping waitlist entry %d: %v", waitlistModel.ID, he.Message)
+		} else {
+			livestreamModel := &LivestreamModel{
+				UserID:       waitlistModel.UserID,
+				Title:        req.Title,
+				Description:  req.Description,
+				PlaylistUrl:  req.PlaylistUrl,
+				ThumbnailUrl: req.ThumbnailUrl,
+				StartAt:      waitlistModel.StartAt,
+				EndAt:        waitlistModel.EndAt,
+				CreatedAt:    time.Now().Unix(),
+			}
+			if err := insertLivestream(ctx, tx, livestreamModel, tagIDs); err != nil {
+				return promoted, err
+			}
+			// 同じキーでの再送には、キャンセル待ちではなく繰り上がった配信を返す
+			if _, err := tx.ExecContext(ctx, "UPDATE reservation_idempotency_keys SET livestream_id = ?, waitlist_id = NULL WHERE waitlist_id = ?", livestreamModel.ID, waitlistModel.ID); err != nil {
+				return promoted, echo.NewHTTPError(http.StatusInternalServerError, "failed to update idempotency key: "+err.Error()).SetInternal(err)
+			}
+			promoted++
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_waitlist WHERE id = ?", waitlistModel.ID); err != nil {
+			return promoted, echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reservation waitlist: "+err.Error()).SetInternal(err)
+		}
+	}
+
+	return promoted, nil
+}
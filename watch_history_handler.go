@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// recordWatchHistory はユーザが配信に入室したことを視聴履歴に残す
+// livestream_viewers_historyは退室で消えるので、視聴履歴は別のテーブルに持つ
+// 同じ配信の履歴は1件にまとめ、入室し直すたびにIDを振り直して最新の入室が先頭に来るようにする
+func recordWatchHistory(ctx context.Context, tx *sqlx.Tx, viewer LivestreamViewerModel) error {
+	if _, err := tx.NamedExecContext(ctx, "REPLACE INTO livestream_watch_history (user_id, livestream_id, viewed_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_watch_history: "+err.Error())
+	}
+	return nil
+}
+
+// 視聴履歴API
+// GET /api/me/history
+// 入室したことのある配信を、最後に入室したのが新しい順に返す
+// ページングはafter_idで行うが、渡すのは配信IDではなくレスポンスのnext_cursor
+func getWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, afterID, err := parseLivestreamFeedPage(c)
+	if err != nil {
+		return err
+	}
+
+	conditions := []string{"livestream_watch_history.user_id = ?"}
+	args := []interface{}{userID}
+	if afterID != nil {
+		conditions = append(conditions, "livestream_watch_history.id < ?")
+		args = append(args, *afterID)
+	}
+
+	tx, err := beginReadOnlyTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var rows []struct {
+		HistoryID int64 `db:"history_id"`
+		LivestreamModel
+	}
+	query := "SELECT livestream_watch_history.id AS history_id, livestreams.* FROM livestream_watch_history JOIN livestreams ON livestreams.id = livestream_watch_history.livestream_id WHERE " + strings.Join(conditions, " AND ") + " ORDER BY livestream_watch_history.id DESC LIMIT ?"
+	if err := tx.SelectContext(ctx, &rows, query, append(args, limit)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+
+	livestreamModels := make([]LivestreamModel, len(rows))
+	for i := range rows {
+		livestreamModels[i] = rows[i].LivestreamModel
+	}
+	livestreams, err := fillLivestreamResponses(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	res := LivestreamFeedResponse{
+		Livestreams: livestreams,
+	}
+	// ページが埋まっていれば続きがあるものとみなす
+	if len(rows) == limit {
+		nextCursor := rows[len(rows)-1].HistoryID
+		res.NextCursor = &nextCursor
+	}
+	return c.JSON(http.StatusOK, res)
+}